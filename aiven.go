@@ -2,6 +2,7 @@ package keys
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,11 +14,65 @@ import (
 	"time"
 )
 
-const aivenTokenEndpoint string = "https://api.aiven.io/v1/access_token"
+const aivenBaseURL string = "https://api.aiven.io"
+const aivenTokenPath string = "/v1/access_token"
 const fullAccountSeparator string = ":"
+const aivenRequestIDHeader string = "X-Request-Id"
+const maxErrorBodyLength int = 512
 
-// AivenKey type
-type AivenKey struct{}
+// AivenKey type. The zero value talks to https://api.aiven.io using a default
+// HTTP client; use NewAivenProvider to supply a client or base URL instead
+type AivenKey struct {
+	httpClient *http.Client
+	baseURL    string
+}
+
+// AivenOption configures an AivenKey created by NewAivenProvider
+type AivenOption func(*AivenKey)
+
+// NewAivenProvider returns an AivenKey configured by opts, for registering
+// with RegisterProviderWithContext
+func NewAivenProvider(opts ...AivenOption) AivenKey {
+	var a AivenKey
+	for _, opt := range opts {
+		opt(&a)
+	}
+	return a
+}
+
+// WithAivenHTTPClient makes the provider send its requests with client, e.g.
+// one configured with a proxy or timeout
+func WithAivenHTTPClient(client *http.Client) AivenOption {
+	return func(a *AivenKey) {
+		a.httpClient = client
+	}
+}
+
+// WithAivenBaseURL makes the provider send its requests to baseURL (e.g.
+// "https://aiven-proxy.example.com") rather than https://api.aiven.io
+func WithAivenBaseURL(baseURL string) AivenOption {
+	return func(a *AivenKey) {
+		a.baseURL = baseURL
+	}
+}
+
+// Use the provider's Endpoint as the base URL, if it sets one, so a single
+// registered AivenKey can serve providers behind different proxies
+func (a AivenKey) forProvider(provider Provider) AivenKey {
+	if provider.Options.Endpoint != "" {
+		a.baseURL = provider.Options.Endpoint
+	}
+	return a
+}
+
+// Get the URL of the access token endpoint
+func (a AivenKey) tokenEndpoint() string {
+	baseURL := a.baseURL
+	if baseURL == "" {
+		baseURL = aivenBaseURL
+	}
+	return strings.TrimSuffix(baseURL, "/") + aivenTokenPath
+}
 
 // Error type
 type Error struct {
@@ -26,11 +81,53 @@ type Error struct {
 	Status   int    `json:"status"`
 }
 
+// AivenAPIError is returned when the Aiven API responds with a non-2xx
+// status. It matches the sentinel error for its status code (e.g.
+// ErrPermissionDenied for a 401) with errors.Is
+type AivenAPIError struct {
+	StatusCode int
+	// RequestID identifies the request to Aiven support, if the API set it
+	RequestID string
+	// Errors are the errors listed in the response body, if any
+	Errors []Error
+	// Message is the message in the response body, or the start of the body
+	// itself if it isn't JSON (e.g. an HTML error page from a proxy)
+	Message string
+}
+
+// Error describes the response status, request ID and errors
+func (e *AivenAPIError) Error() string {
+	msg := fmt.Sprintf("Aiven API responded with status %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	if e.RequestID != "" {
+		msg = fmt.Sprintf("%s (request ID: %s)", msg, e.RequestID)
+	}
+	if len(e.Errors) > 0 {
+		return fmt.Sprintf("%s: %s", msg, apiErrorMessages(e.Errors))
+	}
+	if e.Message != "" {
+		return fmt.Sprintf("%s: %s", msg, e.Message)
+	}
+	return msg
+}
+
+// Is reports whether target is the sentinel error for the response status
+func (e *AivenAPIError) Is(target error) bool {
+	kind := errorKindFromStatus(e.StatusCode, ErrNotFound)
+	return kind != nil && kind == target
+}
+
 // Token type
 type Token struct {
 	CreateTime      string `json:"create_time"`
+	CreatedManually bool   `json:"created_manually"`
 	CurrentlyActive bool   `json:"currently_active"`
 	Description     string `json:"description"`
+	ExpiryTime      string `json:"expiry_time"`
+	ExtendWhenUsed  bool   `json:"extend_when_used"`
+	LastIP          string `json:"last_ip"`
+	LastUsedTime    string `json:"last_used_time"`
+	LastUserAgent   string `json:"last_user_agent"`
+	MaxAgeSeconds   int    `json:"max_age_seconds"`
 	TokenPrefix     string `json:"token_prefix"`
 }
 
@@ -41,6 +138,14 @@ type ListTokensResponse struct {
 	Tokens  []Token `json:"tokens"`
 }
 
+// CreateTokenRequest type
+type CreateTokenRequest struct {
+	Description    string   `json:"description"`
+	ExtendWhenUsed bool     `json:"extend_when_used,omitempty"`
+	MaxAgeSeconds  int      `json:"max_age_seconds,omitempty"`
+	Scopes         []string `json:"scopes,omitempty"`
+}
+
 // CreateTokenResponse type
 type CreateTokenResponse struct {
 	CreateTime      string  `json:"create_time"`
@@ -59,10 +164,15 @@ type RevokeTokenResponse struct {
 	Message string  `json:"message"`
 }
 
-// Generic functions for sending an HTTP request
-func doGenericHTTPReq(method, url, token string, payload io.Reader) (body []byte, err error) {
-	client := http.Client{}
-	req, err := http.NewRequest(method, url, payload)
+// Generic functions for sending an HTTP request to the Aiven API, and
+// decoding its JSON response into v. Any non-2xx response is returned as an
+// AivenAPIError, even if its body parses
+func (a AivenKey) doGenericHTTPReq(ctx context.Context, method, url, token string, payload io.Reader, v interface{}) (err error) {
+	client := a.httpClient
+	if client == nil {
+		client = &http.Client{}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, payload)
 	if err != nil {
 		return
 	}
@@ -72,69 +182,129 @@ func doGenericHTTPReq(method, url, token string, payload io.Reader) (body []byte
 		return
 	}
 	defer resp.Body.Close()
-	return ioutil.ReadAll(resp.Body)
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return newAivenAPIError(resp, body)
+	}
+	if err = json.Unmarshal(body, v); err != nil {
+		err = fmt.Errorf("Failed unmarshalling response: %s, response from Aiven API (status: %d, request ID: %s): %s",
+			err, resp.StatusCode, resp.Header.Get(aivenRequestIDHeader), truncate(string(body), maxErrorBodyLength))
+	}
+	return
 }
 
 // Get the listTokensResponse from the Aiven API
-func listTokensResponse(token string) (ltr ListTokensResponse, err error) {
+func (a AivenKey) listTokensResponse(ctx context.Context, token string) (ltr ListTokensResponse, err error) {
 	// https://api.aiven.io/doc/#tag/User/operation/AccessTokenList
-	body, err := doGenericHTTPReq(
+	err = a.doGenericHTTPReq(
+		ctx,
 		http.MethodGet,
-		aivenTokenEndpoint,
+		a.tokenEndpoint(),
 		token,
 		nil,
+		&ltr,
 	)
-	if err != nil {
-		return
-	}
-	err = json.Unmarshal(body, &ltr)
 	return
 }
 
 // Get the createTokenResponse from the Aiven API
-func createTokenResponse(token, description string) (ctr CreateTokenResponse, err error) {
+func (a AivenKey) createTokenResponse(ctx context.Context, token string, ctReq CreateTokenRequest) (ctr CreateTokenResponse, err error) {
 	// https://api.aiven.io/doc/#tag/User/operation/AccessTokenCreate
-	jsonStr := []byte(fmt.Sprintf("{\"description\":\"%s\"}", description))
-	body, err := doGenericHTTPReq(
+	jsonStr, err := json.Marshal(ctReq)
+	if err != nil {
+		return
+	}
+	err = a.doGenericHTTPReq(
+		ctx,
 		http.MethodPost,
-		aivenTokenEndpoint,
+		a.tokenEndpoint(),
 		token,
 		bytes.NewBuffer(jsonStr),
+		&ctr,
 	)
-	if err != nil {
-		return
-	}
-	err = json.Unmarshal(body, &ctr)
 	return
 }
 
 // Get the revokeTokenResponse from the Aiven API
-func revokeTokenResponse(tokenPrefix, token string) (rtr RevokeTokenResponse, err error) {
+func (a AivenKey) revokeTokenResponse(ctx context.Context, tokenPrefix, token string) (rtr RevokeTokenResponse, err error) {
 	// https://api.aiven.io/doc/#tag/User/operation/AccessTokenRevoke
-	body, err := doGenericHTTPReq(
+	err = a.doGenericHTTPReq(
+		ctx,
 		http.MethodDelete,
-		fmt.Sprintf("%s/%s", aivenTokenEndpoint, tokenPrefix),
+		fmt.Sprintf("%s/%s", a.tokenEndpoint(), tokenPrefix),
 		token,
 		nil,
+		&rtr,
 	)
-	if err != nil {
+	return
+}
+
+// Build an AivenAPIError from a non-2xx response, decoding the errors in its
+// body if it's JSON and keeping the start of it otherwise
+func newAivenAPIError(resp *http.Response, body []byte) *AivenAPIError {
+	apiErr := &AivenAPIError{
+		StatusCode: resp.StatusCode,
+		RequestID:  resp.Header.Get(aivenRequestIDHeader),
+	}
+	// every Aiven response carries the same errors and message fields
+	var errResp RevokeTokenResponse
+	if json.Unmarshal(body, &errResp) == nil {
+		apiErr.Errors = errResp.Errors
+		apiErr.Message = errResp.Message
+	} else {
+		apiErr.Message = truncate(strings.TrimSpace(string(body)), maxErrorBodyLength)
+	}
+	return apiErr
+}
+
+// Shorten str to at most n bytes
+func truncate(str string, n int) string {
+	if len(str) <= n {
+		return str
+	}
+	return str[:n] + "..."
+}
+
+// Build the request to create a token with the given description and options.
+// Aiven takes the max age in whole seconds, so a MaxAge that would round down
+// to 0 (i.e. a token that never expires) is rejected
+func createTokenRequest(description string, options CreateOptions) (req CreateTokenRequest, err error) {
+	if options.MaxAge < 0 || (options.MaxAge > 0 && options.MaxAge < time.Second) {
+		err = &KeyError{Kind: ErrInvalidProvider,
+			Msg: fmt.Sprintf("Aiven token max age %s needs to be 0 (never expires) or at least a second", options.MaxAge)}
 		return
 	}
-	err = json.Unmarshal(body, &rtr)
-	if err != nil {
-		err = fmt.Errorf("Failed unmarshalling response: %s, response from Aiven API: %s", err, string(body[:]))
+	req = CreateTokenRequest{
+		Description:    description,
+		ExtendWhenUsed: options.ExtendWhenUsed,
+		MaxAgeSeconds:  int(options.MaxAge / time.Second),
+		Scopes:         options.Scopes,
 	}
 	return
 }
 
-// Transform a slice of errors (returned in Aiven response) to a single error
+// Transform a slice of errors (returned in Aiven response) to a single error,
+// classified by the status of the first error that matches a sentinel error
 func handleAPIErrors(errs []Error) (err error) {
+	var kind error
+	for _, error := range errs {
+		if kind == nil {
+			kind = errorKindFromStatus(error.Status, ErrNotFound)
+		}
+	}
+	return classifyError(kind, errors.New(apiErrorMessages(errs)))
+}
+
+// Join the messages of a slice of errors (returned in Aiven response)
+func apiErrorMessages(errs []Error) string {
 	var errorMsgs []string
 	for _, error := range errs {
-		msg := fmt.Sprintf("msg: %s, status: %d", error.Message, error.Status)
-		errorMsgs = append(errorMsgs, msg)
+		errorMsgs = append(errorMsgs, fmt.Sprintf("msg: %s, status: %d", error.Message, error.Status))
 	}
-	return errors.New(strings.Join(errorMsgs, ","))
+	return strings.Join(errorMsgs, ",")
 }
 
 // Return a status string (active|inactive)
@@ -159,7 +329,18 @@ func tokenPrefixDescriptionFromFullAccount(account string) (tokenPrefix, tokenDe
 // Keys returns a slice of keys (or tokens in this case) for the user who
 // owns the apiToken
 func (a AivenKey) Keys(project string, includeInactiveKeys bool, apiToken string) (keys []Key, err error) {
-	ltr, err := listTokensResponse(apiToken)
+	return a.KeysWithContext(context.Background(),
+		providerFromArgs(aivenProviderString, project, apiToken), includeInactiveKeys)
+}
+
+// KeysWithContext returns a slice of keys (or tokens in this case) for the
+// user who owns the provider's Credentials (or Token)
+func (a AivenKey) KeysWithContext(ctx context.Context, provider Provider, includeInactiveKeys bool) (keys []Key, err error) {
+	apiToken, err := provider.credentials()
+	if err != nil {
+		return
+	}
+	ltr, err := a.forProvider(provider).listTokensResponse(ctx, apiToken)
 	if err != nil {
 		return
 	}
@@ -168,25 +349,76 @@ func (a AivenKey) Keys(project string, includeInactiveKeys bool, apiToken string
 		return
 	}
 	for _, token := range ltr.Tokens {
-		var createTime time.Time
-		if createTime, err = time.Parse(aivenTimeFormat, token.CreateTime); err != nil {
-			return
-		}
 		// ignore the token if it has no description (this is the identifier
 		// we use to track tokens down that are configured for rotation)
-		tokenDesc := token.Description
-		tokenPrefix := token.TokenPrefix
-		if tokenDesc != "" {
-			key := Key{
-				Account:     tokenDesc,
-				FullAccount: fmt.Sprintf("%s%s%s", tokenPrefix, fullAccountSeparator, tokenDesc),
-				Age:         time.Since(createTime).Minutes(),
-				ID:          tokenPrefix,
-				Name:        tokenDesc,
-				Provider:    Provider{Provider: aivenProviderString, Token: apiToken},
-				Status:      status(token.CurrentlyActive),
-			}
-			keys = append(keys, key)
+		if token.Description == "" {
+			continue
+		}
+		var key Key
+		if key, err = keyFromToken(token, provider); err != nil {
+			return
+		}
+		keys = append(keys, key)
+	}
+	return
+}
+
+// Convert a token to a Key, including when it was last used and how long it
+// has until it expires (if it ever does)
+func keyFromToken(token Token, provider Provider) (key Key, err error) {
+	var createTime, lastUsedTime, expiryTime time.Time
+	if createTime, err = time.Parse(aivenTimeFormat, token.CreateTime); err != nil {
+		return
+	}
+	if lastUsedTime, err = parseOptionalTime(token.LastUsedTime); err != nil {
+		return
+	}
+	if expiryTime, err = parseOptionalTime(token.ExpiryTime); err != nil {
+		return
+	}
+	key = Key{
+		Account:           token.Description,
+		FullAccount:       fmt.Sprintf("%s%s%s", token.TokenPrefix, fullAccountSeparator, token.Description),
+		Age:               time.Since(createTime).Minutes(),
+		ID:                token.TokenPrefix,
+		LastUsed:          lastUsedTime,
+		LastUsedIP:        token.LastIP,
+		LastUsedUserAgent: token.LastUserAgent,
+		Name:              token.Description,
+		Provider:          provider,
+		Status:            status(token.CurrentlyActive),
+	}
+	if !expiryTime.IsZero() {
+		// an expired token's is negative, as 0 means it never expires
+		key.LifeRemaining = time.Until(expiryTime).Minutes()
+	}
+	return
+}
+
+// Parse an Aiven timestamp that may be missing (e.g. a token's expiry time if
+// it never expires), returning the zero time if it is
+func parseOptionalTime(value string) (t time.Time, err error) {
+	if value == "" {
+		return
+	}
+	return time.Parse(aivenTimeFormat, value)
+}
+
+// VerifyKeyWithContext checks an Aiven API token authenticates, by listing
+// tokens with it
+func (a AivenKey) VerifyKeyWithContext(ctx context.Context, provider Provider, credential Credential) (identity Identity, err error) {
+	ltr, err := a.forProvider(provider).listTokensResponse(ctx, credential.Secret)
+	if err != nil {
+		return
+	}
+	if len(ltr.Errors) > 0 {
+		err = handleAPIErrors(ltr.Errors)
+		return
+	}
+	identity.ID = credential.KeyID
+	for _, token := range ltr.Tokens {
+		if token.TokenPrefix == credential.KeyID {
+			identity.Account = token.Description
 		}
 	}
 	return
@@ -194,6 +426,12 @@ func (a AivenKey) Keys(project string, includeInactiveKeys bool, apiToken string
 
 // CreateKey creates a new Aiven API token
 func (a AivenKey) CreateKey(project, account, token string) (keyID string, newKey string, err error) {
+	return a.CreateKeyWithContext(context.Background(),
+		providerFromArgs(aivenProviderString, project, token), account)
+}
+
+// CreateKeyWithContext creates a new Aiven API token
+func (a AivenKey) CreateKeyWithContext(ctx context.Context, provider Provider, account string) (keyID string, newKey string, err error) {
 	if account == "" {
 		err = errors.New("The account string is empty; this is required to explicitly define which keys/tokens to interact with")
 		return
@@ -202,7 +440,15 @@ func (a AivenKey) CreateKey(project, account, token string) (keyID string, newKe
 	if err != nil {
 		return
 	}
-	ctr, err := createTokenResponse(token, description)
+	req, err := createTokenRequest(description, provider.Options.Create)
+	if err != nil {
+		return
+	}
+	apiToken, err := provider.credentials()
+	if err != nil {
+		return
+	}
+	ctr, err := a.forProvider(provider).createTokenResponse(ctx, apiToken, req)
 	if err != nil {
 		return
 	}
@@ -217,14 +463,30 @@ func (a AivenKey) CreateKey(project, account, token string) (keyID string, newKe
 
 // DeleteKey deletes the specified Aiven API token
 func (a AivenKey) DeleteKey(project, account, keyID, token string) (err error) {
-	tokenPrefix, _, err := tokenPrefixDescriptionFromFullAccount(account)
-	if err != nil {
-		return
+	return a.DeleteKeyWithContext(context.Background(), Key{
+		FullAccount: account,
+		ID:          keyID,
+		Provider:    providerFromArgs(aivenProviderString, project, token),
+	})
+}
+
+// DeleteKeyWithContext deletes the specified Aiven API token, identified by
+// its ID (the token prefix), or the prefix in its FullAccount if that's unset
+func (a AivenKey) DeleteKeyWithContext(ctx context.Context, key Key) (err error) {
+	tokenPrefix := key.ID
+	if tokenPrefix == "" {
+		if tokenPrefix, _, err = tokenPrefixDescriptionFromFullAccount(key.FullAccount); err != nil {
+			return
+		}
 	}
 	// tokenPrefix is used in the path in the call to Aiven API, some chars
 	// need escaping otherwise they'll cause a 404
 	tokenPrefix = url.PathEscape(tokenPrefix)
-	rtr, err := revokeTokenResponse(tokenPrefix, token)
+	apiToken, err := key.Provider.credentials()
+	if err != nil {
+		return
+	}
+	rtr, err := a.forProvider(key.Provider).revokeTokenResponse(ctx, tokenPrefix, apiToken)
 	if err != nil {
 		return
 	}
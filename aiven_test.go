@@ -0,0 +1,395 @@
+package keys
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var tokenEndpointTests = []struct {
+	provider AivenKey
+	out      string
+}{
+	{AivenKey{}, "https://api.aiven.io/v1/access_token"},
+	{NewAivenProvider(WithAivenBaseURL("https://proxy.example.com")), "https://proxy.example.com/v1/access_token"},
+	{NewAivenProvider(WithAivenBaseURL("http://localhost:8080/")), "http://localhost:8080/v1/access_token"},
+}
+
+func TestTokenEndpoint(t *testing.T) {
+	for _, test := range tokenEndpointTests {
+		if actual := test.provider.tokenEndpoint(); actual != test.out {
+			t.Errorf("got %q, want %q", actual, test.out)
+		}
+	}
+}
+
+func TestKeyFromToken(t *testing.T) {
+	now := time.Now().UTC()
+	token := Token{
+		CreateTime:      now.Add(-48 * time.Hour).Format(aivenTimeFormat),
+		CurrentlyActive: true,
+		Description:     "rotated-token",
+		ExpiryTime:      now.Add(24 * time.Hour).Format(aivenTimeFormat),
+		ExtendWhenUsed:  true,
+		LastIP:          "192.0.2.1",
+		LastUsedTime:    "2023-09-01T12:00:00.123456Z",
+		LastUserAgent:   "aiven-client/2.0",
+		MaxAgeSeconds:   86400,
+		TokenPrefix:     "abc123",
+	}
+	key, err := keyFromToken(token, Provider{Provider: aivenProviderString})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expectedLastUsed := time.Date(2023, 9, 1, 12, 0, 0, 123456000, time.UTC)
+	if !key.LastUsed.Equal(expectedLastUsed) {
+		t.Errorf("got last used %v, want %v", key.LastUsed, expectedLastUsed)
+	}
+	if key.LastUsedIP != "192.0.2.1" || key.LastUsedUserAgent != "aiven-client/2.0" {
+		t.Errorf("got last used from %q by %q", key.LastUsedIP, key.LastUsedUserAgent)
+	}
+	if key.LifeRemaining < 23*60 || key.LifeRemaining > 24*60 {
+		t.Errorf("got life remaining %f, want about %d", key.LifeRemaining, 24*60)
+	}
+	if key.FullAccount != "abc123:rotated-token" || key.Status != "Active" {
+		t.Errorf("Incorrect key returned, got: %+v", key)
+	}
+}
+
+func TestKeyFromExpiredToken(t *testing.T) {
+	now := time.Now().UTC()
+	token := Token{
+		CreateTime:  now.Add(-48 * time.Hour).Format(aivenTimeFormat),
+		Description: "token",
+		ExpiryTime:  now.Add(-24 * time.Hour).Format(aivenTimeFormat),
+		TokenPrefix: "abc123",
+	}
+	key, err := keyFromToken(token, Provider{Provider: aivenProviderString})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// a LifeRemaining of 0 would mean the token never expires
+	if key.LifeRemaining > -23*60 || key.LifeRemaining < -25*60 {
+		t.Errorf("got life remaining %f, want about %d", key.LifeRemaining, -24*60)
+	}
+}
+
+func TestKeyFromTokenWithoutExpiry(t *testing.T) {
+	token := Token{CreateTime: "2023-01-01T00:00:00Z", Description: "token", TokenPrefix: "abc123"}
+	key, err := keyFromToken(token, Provider{Provider: aivenProviderString})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if key.LifeRemaining != 0 || !key.LastUsed.IsZero() {
+		t.Errorf("got life remaining %f and last used %v, want 0 and zero time", key.LifeRemaining, key.LastUsed)
+	}
+}
+
+var createTokenRequestTests = []struct {
+	description string
+	options     CreateOptions
+	out         string
+}{
+	{"plain", CreateOptions{}, `{"description":"plain"}`},
+	{`with "quotes"`, CreateOptions{}, `{"description":"with \"quotes\""}`},
+	{
+		"bounded",
+		CreateOptions{MaxAge: 30 * 24 * time.Hour, ExtendWhenUsed: true, Scopes: []string{"projects:read"}},
+		`{"description":"bounded","extend_when_used":true,"max_age_seconds":2592000,"scopes":["projects:read"]}`,
+	},
+}
+
+func TestCreateTokenRequest(t *testing.T) {
+	for _, test := range createTokenRequestTests {
+		req, err := createTokenRequest(test.description, test.options)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		actual, err := json.Marshal(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(actual) != test.out {
+			t.Errorf("got %s, want %s", actual, test.out)
+		}
+	}
+}
+
+var aivenStatusTests = []struct {
+	status    int
+	requestID string
+	body      string
+	kind      error
+	contains  string
+}{
+	{http.StatusBadGateway, "", "<html><body>502 Bad Gateway</body></html>", nil, "502 Bad Gateway"},
+	{http.StatusUnauthorized, "req-401", `{"errors": [], "message": "Invalid token"}`, ErrPermissionDenied, "request ID: req-401"},
+	{http.StatusNotFound, "", `{"errors": [{"message": "Not found", "status": 404}]}`, ErrNotFound, "msg: Not found, status: 404"},
+	{http.StatusTooManyRequests, "", ``, ErrRateLimited, "429 Too Many Requests"},
+}
+
+func TestCreateTokenRequestInvalidMaxAge(t *testing.T) {
+	for _, maxAge := range []time.Duration{time.Millisecond, 999 * time.Millisecond, -time.Hour} {
+		if _, err := createTokenRequest("token", CreateOptions{MaxAge: maxAge}); !errors.Is(err, ErrInvalidProvider) {
+			t.Errorf("%s: got error %v, want ErrInvalidProvider", maxAge, err)
+		}
+	}
+}
+
+func TestAivenNon2xxResponses(t *testing.T) {
+	for _, test := range aivenStatusTests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(aivenRequestIDHeader, test.requestID)
+			w.WriteHeader(test.status)
+			fmt.Fprint(w, test.body)
+		}))
+		_, err := NewAivenProvider(WithAivenBaseURL(server.URL)).
+			KeysWithContext(context.Background(), Provider{Provider: aivenProviderString}, true)
+		server.Close()
+
+		var apiErr *AivenAPIError
+		if !errors.As(err, &apiErr) {
+			t.Errorf("%d: got error %v, want AivenAPIError", test.status, err)
+			continue
+		}
+		if apiErr.StatusCode != test.status || apiErr.RequestID != test.requestID {
+			t.Errorf("got status %d and request ID %q, want %d and %q",
+				apiErr.StatusCode, apiErr.RequestID, test.status, test.requestID)
+		}
+		if test.kind != nil && !errors.Is(err, test.kind) {
+			t.Errorf("%d: errors.Is(%v, %v) = false, want true", test.status, err, test.kind)
+		}
+		if !strings.Contains(err.Error(), test.contains) {
+			t.Errorf("%d: got error %q, want it to contain %q", test.status, err, test.contains)
+		}
+	}
+}
+
+func TestAivenInvalidJSONResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(aivenRequestIDHeader, "req-200")
+		fmt.Fprint(w, "not json")
+	}))
+	defer server.Close()
+	_, err := NewAivenProvider(WithAivenBaseURL(server.URL)).
+		KeysWithContext(context.Background(), Provider{Provider: aivenProviderString}, true)
+	if err == nil || !strings.Contains(err.Error(), "request ID: req-200") {
+		t.Errorf("got error %v, want it to include the request ID", err)
+	}
+}
+
+// A request the fake Aiven API received
+type aivenRequest struct {
+	method        string
+	path          string
+	authorization string
+	body          string
+}
+
+// Start a fake Aiven API that records each request it receives and responds
+// with status and body
+func newFakeAivenServer(t *testing.T, status int, body string) (*httptest.Server, *[]aivenRequest) {
+	var requests []aivenRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqBody, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("unexpected error reading request: %s", err)
+		}
+		requests = append(requests, aivenRequest{r.Method, r.URL.EscapedPath(), r.Header.Get("Authorization"), string(reqBody)})
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+var listTokensResponseTests = []struct {
+	name   string
+	status int
+	body   string
+	tokens []string
+	errors int
+	err    bool
+}{
+	{"empty", http.StatusOK, `{"tokens": []}`, nil, 0, false},
+	{
+		"tokens",
+		http.StatusOK,
+		`{"tokens": [{"token_prefix": "abc", "description": "one"}, {"token_prefix": "def", "description": "two"}]}`,
+		[]string{"abc", "def"},
+		0,
+		false,
+	},
+	{"errors in body", http.StatusOK, `{"errors": [{"message": "bad", "status": 400}]}`, nil, 1, false},
+	{"forbidden", http.StatusForbidden, `{"errors": [{"message": "no", "status": 403}]}`, nil, 0, true},
+	{"not json", http.StatusOK, `<html></html>`, nil, 0, true},
+}
+
+func TestListTokensResponse(t *testing.T) {
+	for _, test := range listTokensResponseTests {
+		server, requests := newFakeAivenServer(t, test.status, test.body)
+		ltr, err := NewAivenProvider(WithAivenBaseURL(server.URL)).listTokensResponse(context.Background(), "api-token")
+		if (err != nil) != test.err {
+			t.Errorf("%s: got error %v, want error: %t", test.name, err, test.err)
+		}
+		var prefixes []string
+		for _, token := range ltr.Tokens {
+			prefixes = append(prefixes, token.TokenPrefix)
+		}
+		if !reflect.DeepEqual(prefixes, test.tokens) || len(ltr.Errors) != test.errors {
+			t.Errorf("%s: got tokens %v and %d errors, want %v and %d",
+				test.name, prefixes, len(ltr.Errors), test.tokens, test.errors)
+		}
+		expected := []aivenRequest{{http.MethodGet, aivenTokenPath, "Bearer api-token", ""}}
+		if !reflect.DeepEqual(*requests, expected) {
+			t.Errorf("%s: got requests %+v, want %+v", test.name, *requests, expected)
+		}
+	}
+}
+
+var createTokenResponseTests = []struct {
+	name      string
+	request   CreateTokenRequest
+	status    int
+	body      string
+	sent      string
+	fullToken string
+	err       bool
+}{
+	{
+		"created",
+		CreateTokenRequest{Description: "rotated"},
+		http.StatusOK,
+		`{"token_prefix": "abc", "full_token": "abc-secret"}`,
+		`{"description":"rotated"}`,
+		"abc-secret",
+		false,
+	},
+	{
+		"with options",
+		CreateTokenRequest{Description: "rotated", MaxAgeSeconds: 3600, Scopes: []string{"user:read"}},
+		http.StatusCreated,
+		`{"token_prefix": "abc", "full_token": "abc-secret", "max_age_seconds": 3600}`,
+		`{"description":"rotated","max_age_seconds":3600,"scopes":["user:read"]}`,
+		"abc-secret",
+		false,
+	},
+	{
+		"limit reached",
+		CreateTokenRequest{Description: "rotated"},
+		http.StatusConflict,
+		`{"message": "Too many tokens"}`,
+		`{"description":"rotated"}`,
+		"",
+		true,
+	},
+}
+
+func TestCreateTokenResponse(t *testing.T) {
+	for _, test := range createTokenResponseTests {
+		server, requests := newFakeAivenServer(t, test.status, test.body)
+		ctr, err := NewAivenProvider(WithAivenBaseURL(server.URL)).
+			createTokenResponse(context.Background(), "api-token", test.request)
+		if (err != nil) != test.err {
+			t.Errorf("%s: got error %v, want error: %t", test.name, err, test.err)
+		}
+		if ctr.FullToken != test.fullToken {
+			t.Errorf("%s: got full token %q, want %q", test.name, ctr.FullToken, test.fullToken)
+		}
+		expected := []aivenRequest{{http.MethodPost, aivenTokenPath, "Bearer api-token", test.sent}}
+		if !reflect.DeepEqual(*requests, expected) {
+			t.Errorf("%s: got requests %+v, want %+v", test.name, *requests, expected)
+		}
+	}
+}
+
+var revokeTokenResponseTests = []struct {
+	name        string
+	tokenPrefix string
+	status      int
+	body        string
+	path        string
+	kind        error
+}{
+	{"revoked", "abc", http.StatusOK, `{"message": "Access token revoked"}`, aivenTokenPath + "/abc", nil},
+	{"escaped prefix", url.PathEscape("a/b+c"), http.StatusOK, `{}`, aivenTokenPath + "/a%2Fb+c", nil},
+	{"not found", "abc", http.StatusNotFound, `{"errors": [{"message": "Not found", "status": 404}]}`, aivenTokenPath + "/abc", ErrNotFound},
+	{"unauthorized", "abc", http.StatusUnauthorized, ``, aivenTokenPath + "/abc", ErrPermissionDenied},
+}
+
+func TestRevokeTokenResponse(t *testing.T) {
+	for _, test := range revokeTokenResponseTests {
+		server, requests := newFakeAivenServer(t, test.status, test.body)
+		_, err := NewAivenProvider(WithAivenBaseURL(server.URL)).
+			revokeTokenResponse(context.Background(), test.tokenPrefix, "api-token")
+		if test.kind == nil && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+		if test.kind != nil && !errors.Is(err, test.kind) {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.kind)
+		}
+		expected := []aivenRequest{{http.MethodDelete, test.path, "Bearer api-token", ""}}
+		if !reflect.DeepEqual(*requests, expected) {
+			t.Errorf("%s: got requests %+v, want %+v", test.name, *requests, expected)
+		}
+	}
+}
+
+func TestAivenProviderEndpoint(t *testing.T) {
+	server, requests := newFakeAivenServer(t, http.StatusOK, `{"tokens": []}`)
+	provider := Provider{
+		Provider: aivenProviderString,
+		Options:  ProviderOptions{Endpoint: server.URL, Credentials: "api-token"},
+	}
+	if _, err := (AivenKey{}).KeysWithContext(context.Background(), provider, true); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(*requests) != 1 {
+		t.Errorf("got %d requests to the provider's endpoint, want 1", len(*requests))
+	}
+}
+
+func TestAivenDeleteKeyUsesID(t *testing.T) {
+	server, requests := newFakeAivenServer(t, http.StatusOK, `{}`)
+	provider := Provider{Provider: aivenProviderString, Options: ProviderOptions{Credentials: "api-token"}}
+	for _, key := range []Key{
+		{FullAccount: "old:rotated", ID: "new", Provider: provider},
+		{FullAccount: "old:rotated", Provider: provider},
+	} {
+		if err := NewAivenProvider(WithAivenBaseURL(server.URL)).DeleteKeyWithContext(context.Background(), key); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	expected := []aivenRequest{
+		{http.MethodDelete, aivenTokenPath + "/new", "Bearer api-token", ""},
+		{http.MethodDelete, aivenTokenPath + "/old", "Bearer api-token", ""},
+	}
+	if !reflect.DeepEqual(*requests, expected) {
+		t.Errorf("got requests %+v, want %+v", *requests, expected)
+	}
+}
+
+func TestAivenVerifyKey(t *testing.T) {
+	server, requests := newFakeAivenServer(t, http.StatusOK,
+		`{"tokens": [{"token_prefix": "old", "description": "rotated"}, {"token_prefix": "new", "description": "rotated"}]}`)
+	identity, err := NewAivenProvider(WithAivenBaseURL(server.URL)).VerifyKeyWithContext(context.Background(),
+		Provider{Provider: aivenProviderString}, Credential{Provider: aivenProviderString, KeyID: "new", Secret: "new-token"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if expected := (Identity{Account: "rotated", ID: "new"}); identity != expected {
+		t.Errorf("got identity %+v, want %+v", identity, expected)
+	}
+	if authorization := (*requests)[0].authorization; authorization != "Bearer new-token" {
+		t.Errorf("got authorization %q, want the new token", authorization)
+	}
+}
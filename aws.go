@@ -1,83 +1,223 @@
 package keys
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 
 	awsiam "github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
 )
 
 // API ref: https://docs.aws.amazon.com/sdk-for-go/api/service/iam/
 
-//AwsKey type
-type AwsKey struct{}
+//AwsKey type. The zero value builds an IAM client from the default credential
+//chain on every call; use NewAwsProvider to supply a client or session instead
+type AwsKey struct {
+	iam       iamiface.IAMAPI
+	session   *session.Session
+	newSTSAPI func(creds *credentials.Credentials) stsiface.STSAPI
+}
+
+//AwsRole identifies an IAM role for the AWS provider to assume via STS before
+//listing, creating or deleting keys, so keys in other accounts can be managed
+//from a central one
+type AwsRole struct {
+	//AccountID is the account the role belongs to; it's taken from RoleArn
+	//when empty
+	AccountID string
+	RoleArn   string
+	//ExternalID is passed to sts:AssumeRole if set
+	ExternalID string
+	//SessionName defaults to "cloud-key-client"
+	SessionName string
+}
+
+//AwsOption configures an AwsKey created by NewAwsProvider
+type AwsOption func(*AwsKey)
+
+//NewAwsProvider returns an AwsKey configured by opts, for registering with
+//RegisterProviderWithContext
+func NewAwsProvider(opts ...AwsOption) AwsKey {
+	var a AwsKey
+	for _, opt := range opts {
+		opt(&a)
+	}
+	return a
+}
+
+//WithAwsIAMClient makes the provider use client for all IAM calls, e.g. a fake,
+//or a client with a custom endpoint or credentials. The client is used as-is,
+//so a Provider's AwsRole isn't assumed
+func WithAwsIAMClient(client iamiface.IAMAPI) AwsOption {
+	return func(a *AwsKey) {
+		a.iam = client
+	}
+}
+
+//WithAwsSession makes the provider build its IAM clients from sess rather
+//than the default credential chain. A Provider's AwsRole is assumed using
+//sess's credentials
+func WithAwsSession(sess *session.Session) AwsOption {
+	return func(a *AwsKey) {
+		a.session = sess
+	}
+}
+
+//WithAwsSTSClient makes the provider verify keys with the STS client returned
+//by newClient for the key's credentials, e.g. a fake
+func WithAwsSTSClient(newClient func(creds *credentials.Credentials) stsiface.STSAPI) AwsOption {
+	return func(a *AwsKey) {
+		a.newSTSAPI = newClient
+	}
+}
 
 const (
 	awsAccessKeyLimit = 2
+	awsSessionName    = "cloud-key-client"
 	defaultRegion     = "us-east-1"
-	maxKeys           = 5
-	maxUsers          = 1000
+	maxKeys           = 5    // page size when listing a user's access keys
+	maxUsers          = 1000 // page size when listing users
 )
 
+//awsLastUsedNotApplicable is IAM's last used service and region for keys that
+//have never been used
+const awsLastUsedNotApplicable = "N/A"
+
 //Keys returns a slice of keys from any authorised accounts
 func (a AwsKey) Keys(project string, includeInactiveKeys bool, token string) (keys []Key, err error) {
-	var svc *awsiam.IAM
-	if svc, err = iamService(); err != nil {
+	return a.KeysWithContext(context.Background(),
+		providerFromArgs(awsProviderString, project, token), includeInactiveKeys)
+}
+
+//KeysWithContext returns a slice of keys from any authorised accounts. Each
+//key's Provider records the account (via AwsRole) it came from
+func (a AwsKey) KeysWithContext(ctx context.Context, provider Provider, includeInactiveKeys bool) (keys []Key, err error) {
+	var svc iamiface.IAMAPI
+	if provider, svc, err = a.iamService(provider); err != nil {
 		return
 	}
 	var userList []*awsiam.User
-	if userList, err = awsUserList(*svc); err != nil {
+	if userList, err = awsUserList(ctx, svc); err != nil {
 		return
 	}
 	for _, user := range userList {
-		var keyList []*awsiam.AccessKeyMetadata
-		if keyList, err = awsKeyList(*user.UserName, *svc); err != nil {
+		var userKeys []Key
+		if userKeys, err = awsUserKeys(ctx, *user.UserName, includeInactiveKeys, svc, provider); err != nil {
 			return
 		}
-		for _, awsKey := range keyList {
-			if includeInactiveKeys || *awsKey.Status == "Active" {
-				keyID := *awsKey.AccessKeyId
-				keys = append(keys, Key{
-					*awsKey.UserName,
-					*awsKey.UserName,
-					time.Since(*awsKey.CreateDate).Minutes(),
-					keyID,
-					0,
-					strings.Join([]string{*awsKey.UserName,
-						keyID[len(keyID)-numIDValuesInName:]}, "_"),
-					Provider{Provider: awsProviderString},
-					*awsKey.Status,
-				})
+		keys = append(keys, userKeys...)
+	}
+	return
+}
+
+//awsUserKeys returns the keys of a single user, including when each was last
+//used where that's available
+func awsUserKeys(ctx context.Context, username string, includeInactiveKeys bool, iamService iamiface.IAMAPI, provider Provider) (keys []Key, err error) {
+	var keyList []*awsiam.AccessKeyMetadata
+	if keyList, err = awsKeyList(ctx, username, iamService); err != nil {
+		return
+	}
+	for _, awsKey := range keyList {
+		if includeInactiveKeys || *awsKey.Status == "Active" {
+			key := keyFromAwsKey(awsKey, provider)
+			// last used details are best effort, e.g. the caller may lack
+			// iam:GetAccessKeyLastUsed, so failing to get them leaves them
+			// empty rather than failing the listing
+			if setAwsKeyLastUsed(ctx, &key, iamService) != nil && ctx.Err() != nil {
+				err = ctx.Err()
+				return
 			}
+			keys = append(keys, key)
 		}
 	}
 	return
 }
 
+//setAwsKeyLastUsed sets the LastUsed fields of key from the IAM service
+func setAwsKeyLastUsed(ctx context.Context, key *Key, iamService iamiface.IAMAPI) (err error) {
+	var result *awsiam.GetAccessKeyLastUsedOutput
+	if result, err = iamService.GetAccessKeyLastUsedWithContext(ctx, &awsiam.GetAccessKeyLastUsedInput{
+		AccessKeyId: aws.String(key.ID),
+	}); err != nil {
+		err = awsError(err, ErrNotFound)
+		return
+	}
+	lastUsed := result.AccessKeyLastUsed
+	if lastUsed == nil {
+		return
+	}
+	key.LastUsed = aws.TimeValue(lastUsed.LastUsedDate)
+	key.LastUsedService = awsLastUsedValue(lastUsed.ServiceName)
+	key.LastUsedRegion = awsLastUsedValue(lastUsed.Region)
+	return
+}
+
+//awsLastUsedValue returns the value of a last used field, or an empty string
+//if IAM reports it as "N/A" (i.e. the key has never been used)
+func awsLastUsedValue(value *string) string {
+	if aws.StringValue(value) == awsLastUsedNotApplicable {
+		return ""
+	}
+	return aws.StringValue(value)
+}
+
+//keyFromAwsKey converts IAM access key metadata to a Key
+func keyFromAwsKey(awsKey *awsiam.AccessKeyMetadata, provider Provider) Key {
+	keyID := *awsKey.AccessKeyId
+	return Key{
+		Account:     *awsKey.UserName,
+		FullAccount: *awsKey.UserName,
+		Age:         time.Since(*awsKey.CreateDate).Minutes(),
+		ID:          keyID,
+		Name: strings.Join([]string{*awsKey.UserName,
+			keyID[len(keyID)-numIDValuesInName:]}, "_"),
+		Provider: provider,
+		Status:   *awsKey.Status,
+	}
+}
+
 //CreateKey creates a key in the provided account
 func (a AwsKey) CreateKey(project, account, token string) (keyID, newKey string, err error) {
-	var svc *awsiam.IAM
-	if svc, err = iamService(); err != nil {
+	return a.CreateKeyWithContext(context.Background(),
+		providerFromArgs(awsProviderString, project, token), account)
+}
+
+//CreateKeyWithContext creates a key in the provided account
+func (a AwsKey) CreateKeyWithContext(ctx context.Context, provider Provider, account string) (keyID, newKey string, err error) {
+	var svc iamiface.IAMAPI
+	if _, svc, err = a.iamService(provider); err != nil {
 		return
 	}
 	var keyList []*awsiam.AccessKeyMetadata
-	if keyList, err = awsKeyList(account, *svc); err != nil {
+	if keyList, err = awsKeyList(ctx, account, svc); err != nil {
 		return
 	}
 	keyNum := len(keyList)
 	if keyNum >= awsAccessKeyLimit {
-		err = fmt.Errorf("Number of Access Keys for user: %s is already at its limit (%d)",
-			account, awsAccessKeyLimit)
+		err = &KeyError{
+			Kind: ErrKeyLimitReached,
+			Msg: fmt.Sprintf("Number of Access Keys for user: %s is already at its limit (%d)",
+				account, awsAccessKeyLimit),
+		}
 		return
 	}
 	var key *awsiam.CreateAccessKeyOutput
-	if key, err = svc.CreateAccessKey(&awsiam.CreateAccessKeyInput{
+	if key, err = svc.CreateAccessKeyWithContext(ctx, &awsiam.CreateAccessKeyInput{
 		UserName: aws.String(account),
 	}); err != nil {
+		err = awsError(err, ErrAccountNotFound)
 		return
 	}
 	accessKey := key.AccessKey
@@ -88,17 +228,100 @@ func (a AwsKey) CreateKey(project, account, token string) (keyID, newKey string,
 
 //DeleteKey deletes the specified key from the specified account
 func (a AwsKey) DeleteKey(project, account, keyID, token string) (err error) {
-	var svc *awsiam.IAM
-	if svc, err = iamService(); err != nil {
+	return a.DeleteKeyWithContext(context.Background(), Key{
+		FullAccount: account,
+		ID:          keyID,
+		Provider:    providerFromArgs(awsProviderString, project, token),
+	})
+}
+
+//DeleteKeyWithContext deletes the specified key from its account
+func (a AwsKey) DeleteKeyWithContext(ctx context.Context, key Key) (err error) {
+	var svc iamiface.IAMAPI
+	if _, svc, err = a.iamService(key.Provider); err != nil {
 		return
 	}
-	_, err = svc.DeleteAccessKey(&awsiam.DeleteAccessKeyInput{
-		AccessKeyId: aws.String(keyID),
-		UserName:    aws.String(account),
-	})
+	if _, err = svc.DeleteAccessKeyWithContext(ctx, &awsiam.DeleteAccessKeyInput{
+		AccessKeyId: aws.String(key.ID),
+		UserName:    aws.String(key.FullAccount),
+	}); err != nil {
+		err = awsError(err, ErrNotFound)
+	}
 	return
 }
 
+//DisableKeyWithContext makes the specified key Inactive
+func (a AwsKey) DisableKeyWithContext(ctx context.Context, key Key) (err error) {
+	return a.updateKeyStatus(ctx, key, awsiam.StatusTypeInactive)
+}
+
+//EnableKeyWithContext makes the specified key Active
+func (a AwsKey) EnableKeyWithContext(ctx context.Context, key Key) (err error) {
+	return a.updateKeyStatus(ctx, key, awsiam.StatusTypeActive)
+}
+
+//updateKeyStatus sets the status of the specified key
+func (a AwsKey) updateKeyStatus(ctx context.Context, key Key, status string) (err error) {
+	var svc iamiface.IAMAPI
+	if _, svc, err = a.iamService(key.Provider); err != nil {
+		return
+	}
+	if _, err = svc.UpdateAccessKeyWithContext(ctx, &awsiam.UpdateAccessKeyInput{
+		AccessKeyId: aws.String(key.ID),
+		Status:      aws.String(status),
+		UserName:    aws.String(key.FullAccount),
+	}); err != nil {
+		err = awsError(err, ErrNotFound)
+	}
+	return
+}
+
+//VerifyKeyWithContext checks an access key authenticates, by calling
+//sts:GetCallerIdentity with it
+func (a AwsKey) VerifyKeyWithContext(ctx context.Context, provider Provider, credential Credential) (identity Identity, err error) {
+	var svc stsiface.STSAPI
+	if svc, err = a.stsService(provider, credentials.NewStaticCredentials(credential.KeyID, credential.Secret, "")); err != nil {
+		return
+	}
+	var res *sts.GetCallerIdentityOutput
+	// a new key is rejected as InvalidClientTokenId until it's propagated
+	if err = retryWhileDenied(ctx, func() (callErr error) {
+		if res, callErr = svc.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{}); callErr != nil {
+			callErr = awsError(callErr, ErrNotFound)
+		}
+		return
+	}); err != nil {
+		return
+	}
+	identity.ID = aws.StringValue(res.Arn)
+	var callerArn arn.ARN
+	if callerArn, err = arn.Parse(identity.ID); err != nil {
+		return
+	}
+	// the ARN of an IAM user's key is "arn:aws:iam::ACCOUNT:user/[PATH/]NAME"
+	resource := strings.Split(callerArn.Resource, "/")
+	identity.Account = resource[len(resource)-1]
+	return
+}
+
+//stsService returns an STS client that authenticates with creds
+func (a AwsKey) stsService(provider Provider, creds *credentials.Credentials) (svc stsiface.STSAPI, err error) {
+	if a.newSTSAPI != nil {
+		return a.newSTSAPI(creds), nil
+	}
+	awsSess := a.session
+	if awsSess == nil {
+		if awsSess, err = awsSession(); err != nil {
+			return
+		}
+	}
+	config := &aws.Config{Credentials: creds}
+	if provider.Options.Region != "" {
+		config.Region = aws.String(provider.Options.Region)
+	}
+	return sts.New(awsSess, config), nil
+}
+
 //awsSession creates a new AWS SDK session
 func awsSession() (*session.Session, error) {
 	return session.NewSession(&aws.Config{
@@ -106,37 +329,143 @@ func awsSession() (*session.Session, error) {
 	)
 }
 
-func iamService() (iamService *awsiam.IAM, err error) {
-	var awsSess *session.Session
-	if awsSess, err = awsSession(); err != nil {
+//iamService returns the IAM client to use for provider, assuming its AwsRole
+//if it has one. provider is returned with its AwsRole's defaults filled in
+func (a AwsKey) iamService(provider Provider) (resolved Provider, iamService iamiface.IAMAPI, err error) {
+	resolved = provider
+	if resolved.AwsRole, err = resolveAwsRole(provider.AwsRole); err != nil {
+		return
+	}
+	if a.iam != nil {
+		iamService = a.iam
 		return
 	}
-	iamService = awsiam.New(awsSess)
+	awsSess := a.session
+	if awsSess == nil {
+		if awsSess, err = awsSession(); err != nil {
+			return
+		}
+	}
+	configs := append(awsRoleConfig(awsSess, resolved.AwsRole), awsOptionsConfig(resolved.Options))
+	iamService = awsiam.New(awsSess, configs...)
 	return
 }
 
-//awsUserList obtains a slice of Users from the AWS IAM service
-func awsUserList(iamService awsiam.IAM) (users []*awsiam.User, err error) {
-	var userResult *awsiam.ListUsersOutput
-	if userResult, err = iamService.ListUsers(&awsiam.ListUsersInput{
-		MaxItems: aws.Int64(maxUsers),
-	}); err != nil {
+//awsOptionsConfig returns the config set by a Provider's Region and Endpoint
+func awsOptionsConfig(options ProviderOptions) *aws.Config {
+	config := &aws.Config{}
+	if options.Region != "" {
+		config.Region = aws.String(options.Region)
+	}
+	if options.Endpoint != "" {
+		config.Endpoint = aws.String(options.Endpoint)
+	}
+	return config
+}
+
+//awsRoleConfig returns the config needed for a client to assume role, if any
+func awsRoleConfig(awsSess *session.Session, role AwsRole) []*aws.Config {
+	if role.RoleArn == "" {
+		return nil
+	}
+	creds := stscreds.NewCredentials(awsSess, role.RoleArn, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = role.SessionName
+		if role.ExternalID != "" {
+			p.ExternalID = aws.String(role.ExternalID)
+		}
+	})
+	return []*aws.Config{{Credentials: creds}}
+}
+
+//resolveAwsRole validates role, and fills in its AccountID and SessionName if
+//they're empty
+func resolveAwsRole(role AwsRole) (resolved AwsRole, err error) {
+	resolved = role
+	if role.RoleArn == "" {
+		if role.AccountID != "" {
+			err = &KeyError{Kind: ErrInvalidProvider, Msg: "AWS role ARN needs to be set along with the account ID"}
+		}
 		return
 	}
-	users = userResult.Users
+	var roleArn arn.ARN
+	if roleArn, err = arn.Parse(role.RoleArn); err != nil {
+		err = &KeyError{Kind: ErrInvalidProvider, Msg: "AWS role ARN is invalid", Err: err}
+		return
+	}
+	if role.AccountID == "" {
+		resolved.AccountID = roleArn.AccountID
+	} else if role.AccountID != roleArn.AccountID {
+		err = &KeyError{Kind: ErrInvalidProvider, Msg: fmt.Sprintf(
+			"AWS account ID %s doesn't match role ARN %s", role.AccountID, role.RoleArn)}
+		return
+	}
+	if role.SessionName == "" {
+		resolved.SessionName = awsSessionName
+	}
+	return
+}
+
+//awsUserList obtains a slice of every User from the AWS IAM service,
+//following the Marker of truncated results until all pages are read
+func awsUserList(ctx context.Context, iamService iamiface.IAMAPI) (users []*awsiam.User, err error) {
+	input := &awsiam.ListUsersInput{MaxItems: aws.Int64(maxUsers)}
+	for {
+		var userResult *awsiam.ListUsersOutput
+		if userResult, err = iamService.ListUsersWithContext(ctx, input); err != nil {
+			err = awsError(err, ErrNotFound)
+			return
+		}
+		users = append(users, userResult.Users...)
+		if !aws.BoolValue(userResult.IsTruncated) {
+			break
+		}
+		input.Marker = userResult.Marker
+	}
 	return
 }
 
 //awsKeyList obtains a slice of accessKeyMetadata from the specified User's account
-//using the AWS IAM service
-func awsKeyList(username string, iamService awsiam.IAM) (accessKeyMetadata []*awsiam.AccessKeyMetadata, err error) {
-	var result *awsiam.ListAccessKeysOutput
-	if result, err = iamService.ListAccessKeys(&awsiam.ListAccessKeysInput{
+//using the AWS IAM service, following the Marker of truncated results until
+//all pages are read
+func awsKeyList(ctx context.Context, username string, iamService iamiface.IAMAPI) (accessKeyMetadata []*awsiam.AccessKeyMetadata, err error) {
+	input := &awsiam.ListAccessKeysInput{
 		MaxItems: aws.Int64(maxKeys),
 		UserName: aws.String(username),
-	}); err != nil {
-		return
 	}
-	accessKeyMetadata = result.AccessKeyMetadata
+	for {
+		var result *awsiam.ListAccessKeysOutput
+		if result, err = iamService.ListAccessKeysWithContext(ctx, input); err != nil {
+			err = awsError(err, ErrAccountNotFound)
+			return
+		}
+		accessKeyMetadata = append(accessKeyMetadata, result.AccessKeyMetadata...)
+		if !aws.BoolValue(result.IsTruncated) {
+			break
+		}
+		input.Marker = result.Marker
+	}
 	return
 }
+
+//awsError classifies an AWS SDK error as one of the package's sentinel errors,
+//using notFound for a NoSuchEntity error. Unrecognised errors are returned
+//unchanged
+func awsError(err error, notFound error) error {
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) {
+		return err
+	}
+	var kind error
+	switch awsErr.Code() {
+	case awsiam.ErrCodeNoSuchEntityException:
+		kind = notFound
+	case awsiam.ErrCodeLimitExceededException:
+		kind = ErrKeyLimitReached
+	case "AccessDenied", "AccessDeniedException", "InvalidClientTokenId",
+		"ExpiredToken", "SignatureDoesNotMatch":
+		kind = ErrPermissionDenied
+	case "Throttling", "ThrottlingException", "RequestLimitExceeded":
+		kind = ErrRateLimited
+	}
+	return classifyError(kind, err)
+}
@@ -0,0 +1,312 @@
+package keys
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	awsiam "github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+)
+
+// stubIAM serves canned IAM responses, split into pages that are linked by
+// Marker the same way the IAM API links truncated results
+type stubIAM struct {
+	iamiface.IAMAPI
+	userPages [][]*awsiam.User
+	keyPages  map[string][][]*awsiam.AccessKeyMetadata
+	lastUsed  map[string]*awsiam.AccessKeyLastUsed
+	// lastUsedErr fails every GetAccessKeyLastUsed call if it's set
+	lastUsedErr error
+	updated     map[string]string
+}
+
+// page returns the index of the page a Marker refers to, and the Marker of
+// the following page if there is one
+func page(marker *string, numPages int) (index int, truncated bool, nextMarker *string) {
+	index, _ = strconv.Atoi(aws.StringValue(marker))
+	if index+1 < numPages {
+		truncated = true
+		nextMarker = aws.String(strconv.Itoa(index + 1))
+	}
+	return
+}
+
+func (s *stubIAM) ListUsersWithContext(ctx aws.Context, input *awsiam.ListUsersInput, opts ...request.Option) (*awsiam.ListUsersOutput, error) {
+	index, truncated, marker := page(input.Marker, len(s.userPages))
+	return &awsiam.ListUsersOutput{
+		Users:       s.userPages[index],
+		IsTruncated: aws.Bool(truncated),
+		Marker:      marker,
+	}, nil
+}
+
+func (s *stubIAM) ListAccessKeysWithContext(ctx aws.Context, input *awsiam.ListAccessKeysInput, opts ...request.Option) (*awsiam.ListAccessKeysOutput, error) {
+	pages := s.keyPages[aws.StringValue(input.UserName)]
+	index, truncated, marker := page(input.Marker, len(pages))
+	return &awsiam.ListAccessKeysOutput{
+		AccessKeyMetadata: pages[index],
+		IsTruncated:       aws.Bool(truncated),
+		Marker:            marker,
+	}, nil
+}
+
+func (s *stubIAM) GetAccessKeyLastUsedWithContext(ctx aws.Context, input *awsiam.GetAccessKeyLastUsedInput, opts ...request.Option) (*awsiam.GetAccessKeyLastUsedOutput, error) {
+	if s.lastUsedErr != nil {
+		return nil, s.lastUsedErr
+	}
+	lastUsed, ok := s.lastUsed[aws.StringValue(input.AccessKeyId)]
+	if !ok {
+		lastUsed = &awsiam.AccessKeyLastUsed{
+			Region:      aws.String(awsLastUsedNotApplicable),
+			ServiceName: aws.String(awsLastUsedNotApplicable),
+		}
+	}
+	return &awsiam.GetAccessKeyLastUsedOutput{AccessKeyLastUsed: lastUsed}, nil
+}
+
+func (s *stubIAM) UpdateAccessKeyWithContext(ctx aws.Context, input *awsiam.UpdateAccessKeyInput, opts ...request.Option) (*awsiam.UpdateAccessKeyOutput, error) {
+	s.updated[aws.StringValue(input.UserName)+"/"+aws.StringValue(input.AccessKeyId)] = aws.StringValue(input.Status)
+	return &awsiam.UpdateAccessKeyOutput{}, nil
+}
+
+func awsTestUsers(names ...string) (users []*awsiam.User) {
+	for _, name := range names {
+		users = append(users, &awsiam.User{UserName: aws.String(name)})
+	}
+	return
+}
+
+func awsTestKeys(username string, ids ...string) (keys []*awsiam.AccessKeyMetadata) {
+	for _, id := range ids {
+		keys = append(keys, &awsiam.AccessKeyMetadata{
+			AccessKeyId: aws.String(id),
+			CreateDate:  aws.Time(time.Now().Add(-time.Hour)),
+			Status:      aws.String("Active"),
+			UserName:    aws.String(username),
+		})
+	}
+	return
+}
+
+func TestAwsUserListFollowsMarker(t *testing.T) {
+	svc := &stubIAM{userPages: [][]*awsiam.User{
+		awsTestUsers("one", "two"),
+		awsTestUsers("three"),
+		awsTestUsers("four", "five"),
+	}}
+	users, err := awsUserList(context.Background(), svc)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var names []string
+	for _, user := range users {
+		names = append(names, *user.UserName)
+	}
+	expected := []string{"one", "two", "three", "four", "five"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Incorrect users returned, got: %v, want: %v.", names, expected)
+	}
+}
+
+func TestAwsKeyListFollowsMarker(t *testing.T) {
+	svc := &stubIAM{keyPages: map[string][][]*awsiam.AccessKeyMetadata{
+		"user": {awsTestKeys("user", "AKIA1"), awsTestKeys("user", "AKIA2")},
+	}}
+	keys, err := awsKeyList(context.Background(), "user", svc)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var ids []string
+	for _, key := range keys {
+		ids = append(ids, *key.AccessKeyId)
+	}
+	expected := []string{"AKIA1", "AKIA2"}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Errorf("Incorrect keys returned, got: %v, want: %v.", ids, expected)
+	}
+}
+
+func TestAwsProviderUsesInjectedClient(t *testing.T) {
+	svc := &stubIAM{
+		userPages: [][]*awsiam.User{awsTestUsers("one"), awsTestUsers("two")},
+		keyPages: map[string][][]*awsiam.AccessKeyMetadata{
+			"one": {awsTestKeys("one", "AKIAONE111111")},
+			"two": {awsTestKeys("two", "AKIATWO222222")},
+		},
+	}
+	keys, err := NewAwsProvider(WithAwsIAMClient(svc)).
+		KeysWithContext(context.Background(), Provider{Provider: awsProviderString}, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("got %d keys, want 2", len(keys))
+	}
+	if keys[1].ID != "AKIATWO222222" || keys[1].Name != "two_222222" {
+		t.Errorf("Incorrect key returned, got: %+v", keys[1])
+	}
+}
+
+var resolveAwsRoleTests = []struct {
+	in  AwsRole
+	out AwsRole
+	err error
+}{
+	{AwsRole{}, AwsRole{}, nil},
+	{
+		AwsRole{RoleArn: "arn:aws:iam::123456789012:role/key-rotation"},
+		AwsRole{AccountID: "123456789012", RoleArn: "arn:aws:iam::123456789012:role/key-rotation", SessionName: "cloud-key-client"},
+		nil,
+	},
+	{
+		AwsRole{AccountID: "123456789012", RoleArn: "arn:aws:iam::123456789012:role/key-rotation", ExternalID: "ext", SessionName: "nightly"},
+		AwsRole{AccountID: "123456789012", RoleArn: "arn:aws:iam::123456789012:role/key-rotation", ExternalID: "ext", SessionName: "nightly"},
+		nil,
+	},
+	{AwsRole{AccountID: "123456789012"}, AwsRole{}, ErrInvalidProvider},
+	{AwsRole{RoleArn: "key-rotation"}, AwsRole{}, ErrInvalidProvider},
+	{AwsRole{AccountID: "210987654321", RoleArn: "arn:aws:iam::123456789012:role/key-rotation"}, AwsRole{}, ErrInvalidProvider},
+}
+
+func TestResolveAwsRole(t *testing.T) {
+	for _, test := range resolveAwsRoleTests {
+		actual, err := resolveAwsRole(test.in)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%+v: got error %v, want %v", test.in, err, test.err)
+		} else if err == nil && actual != test.out {
+			t.Errorf("got %+v, want %+v", actual, test.out)
+		}
+	}
+}
+
+func TestAwsKeysRecordAccount(t *testing.T) {
+	svc := &stubIAM{
+		userPages: [][]*awsiam.User{awsTestUsers("one")},
+		keyPages:  map[string][][]*awsiam.AccessKeyMetadata{"one": {awsTestKeys("one", "AKIAONE111111")}},
+	}
+	provider := Provider{
+		Provider: awsProviderString,
+		AwsRole:  AwsRole{RoleArn: "arn:aws:iam::123456789012:role/key-rotation"},
+	}
+	keys, err := NewAwsProvider(WithAwsIAMClient(svc)).KeysWithContext(context.Background(), provider, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if accountID := keys[0].Provider.AwsRole.AccountID; accountID != "123456789012" {
+		t.Errorf("got account ID %q, want %q", accountID, "123456789012")
+	}
+}
+
+func TestAwsKeysLastUsed(t *testing.T) {
+	lastUsed := time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC)
+	svc := &stubIAM{
+		userPages: [][]*awsiam.User{awsTestUsers("one")},
+		keyPages:  map[string][][]*awsiam.AccessKeyMetadata{"one": {awsTestKeys("one", "AKIAUSED11111", "AKIAUNUSED222")}},
+		lastUsed: map[string]*awsiam.AccessKeyLastUsed{"AKIAUSED11111": {
+			LastUsedDate: aws.Time(lastUsed),
+			Region:       aws.String("eu-west-1"),
+			ServiceName:  aws.String("s3"),
+		}},
+	}
+	keys, err := NewAwsProvider(WithAwsIAMClient(svc)).
+		KeysWithContext(context.Background(), Provider{Provider: awsProviderString}, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	used, unused := keys[0], keys[1]
+	if !used.LastUsed.Equal(lastUsed) || used.LastUsedService != "s3" || used.LastUsedRegion != "eu-west-1" {
+		t.Errorf("Incorrect last used details, got: %v, %q, %q", used.LastUsed, used.LastUsedService, used.LastUsedRegion)
+	}
+	if !unused.LastUsed.IsZero() || unused.LastUsedService != "" || unused.LastUsedRegion != "" {
+		t.Errorf("Incorrect last used details, got: %v, %q, %q", unused.LastUsed, unused.LastUsedService, unused.LastUsedRegion)
+	}
+}
+
+func TestAwsKeysLastUsedDenied(t *testing.T) {
+	svc := &stubIAM{
+		userPages:   [][]*awsiam.User{awsTestUsers("one")},
+		keyPages:    map[string][][]*awsiam.AccessKeyMetadata{"one": {awsTestKeys("one", "AKIAONE111111")}},
+		lastUsedErr: awserr.New("AccessDenied", "not authorized to perform: iam:GetAccessKeyLastUsed", nil),
+	}
+	keys, err := NewAwsProvider(WithAwsIAMClient(svc)).
+		KeysWithContext(context.Background(), Provider{Provider: awsProviderString}, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(keys) != 1 || keys[0].ID != "AKIAONE111111" || !keys[0].LastUsed.IsZero() {
+		t.Errorf("Incorrect keys returned, got: %+v, want the key without last used details", keys)
+	}
+}
+
+func TestAwsDisableEnableKey(t *testing.T) {
+	svc := &stubIAM{updated: map[string]string{}}
+	provider := NewAwsProvider(WithAwsIAMClient(svc))
+	key := Key{FullAccount: "one", ID: "AKIAONE111111", Provider: Provider{Provider: awsProviderString}}
+	if err := provider.DisableKeyWithContext(context.Background(), key); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if status := svc.updated["one/AKIAONE111111"]; status != "Inactive" {
+		t.Errorf("got status %q, want %q", status, "Inactive")
+	}
+	if err := provider.EnableKeyWithContext(context.Background(), key); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if status := svc.updated["one/AKIAONE111111"]; status != "Active" {
+		t.Errorf("got status %q, want %q", status, "Active")
+	}
+}
+
+// stubSTS answers sts:GetCallerIdentity for the credentials it was built with
+type stubSTS struct {
+	stsiface.STSAPI
+	creds *credentials.Credentials
+	// unpropagated is how many more calls reject even valid credentials, as
+	// happens just after a key is created
+	unpropagated *int
+}
+
+func (s stubSTS) GetCallerIdentityWithContext(ctx aws.Context, input *sts.GetCallerIdentityInput, opts ...request.Option) (*sts.GetCallerIdentityOutput, error) {
+	value, err := s.creds.Get()
+	if err != nil {
+		return nil, err
+	}
+	if s.unpropagated != nil && *s.unpropagated > 0 {
+		*s.unpropagated--
+		return nil, awserr.New("InvalidClientTokenId", "The security token included in the request is invalid", nil)
+	}
+	if value.AccessKeyID != "AKIAONE111111" || value.SecretAccessKey != "secret" {
+		return nil, awserr.New("InvalidClientTokenId", "The security token included in the request is invalid", nil)
+	}
+	return &sts.GetCallerIdentityOutput{Arn: aws.String("arn:aws:iam::123456789012:user/team/one")}, nil
+}
+
+func TestAwsVerifyKey(t *testing.T) {
+	defer shortenVerifyRetries()()
+	unpropagated := 2
+	provider := NewAwsProvider(WithAwsSTSClient(func(creds *credentials.Credentials) stsiface.STSAPI {
+		return stubSTS{creds: creds, unpropagated: &unpropagated}
+	}))
+	identity, err := provider.VerifyKeyWithContext(context.Background(), Provider{Provider: awsProviderString},
+		Credential{Provider: awsProviderString, KeyID: "AKIAONE111111", Secret: "secret"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := Identity{Account: "one", ID: "arn:aws:iam::123456789012:user/team/one"}
+	if identity != expected {
+		t.Errorf("got identity %+v, want %+v", identity, expected)
+	}
+	if _, err = provider.VerifyKeyWithContext(context.Background(), Provider{Provider: awsProviderString},
+		Credential{Provider: awsProviderString, KeyID: "AKIAONE111111", Secret: "wrong"}); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("got error %v, want ErrPermissionDenied for an invalid key", err)
+	}
+}
@@ -0,0 +1,518 @@
+//Command cloud-key-client lists, creates, deletes, rotates and audits keys
+//across the providers supported by the keys package.
+//
+//Usage:
+//
+//	cloud-key-client <list|create|delete|rotate|audit> [flags]
+//
+//Providers come from a config file (--config) or from flags (--provider,
+//--scope, ...); run a subcommand with -h to see its flags.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+
+	keys "github.com/ovotech/cloud-key-client"
+)
+
+//Exit statuses
+const (
+	exitOK           = 0
+	exitError        = 1
+	exitUsage        = 2
+	exitNonCompliant = 3
+)
+
+const (
+	aivenProviderName = "aiven"
+	//aivenAccountSeparator separates the token prefix and description of an
+	//Aiven key's FullAccount
+	aivenAccountSeparator = ":"
+)
+
+const usage = `Usage: cloud-key-client <command> [flags]
+
+Commands:
+  list    list keys
+  create  create a key in an account
+  delete  delete a key
+  rotate  replace a key with a new one, then delete (or disable) the old key
+  audit   classify keys against the config's rotation policy
+
+Run "cloud-key-client <command> -h" for a command's flags.
+`
+
+//commands maps each subcommand to the func that runs it
+var commands = map[string]func(ctx context.Context, cmd *command) error{
+	"list":   runList,
+	"create": runCreate,
+	"delete": runDelete,
+	"rotate": runRotate,
+	"audit":  runAudit,
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	os.Exit(run(ctx, os.Args[1:], os.Stdout, os.Stderr))
+}
+
+//run runs the subcommand named by args[0], returning the exit status
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || commands[args[0]] == nil {
+		fmt.Fprint(stderr, usage)
+		return exitUsage
+	}
+	cmd := newCommand(args[0], stdout, stderr)
+	if err := cmd.flags.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	err := commands[args[0]](ctx, cmd)
+	var usageErr usageError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &usageErr):
+		fmt.Fprintf(stderr, "%s\n", err)
+		cmd.flags.Usage()
+		return exitUsage
+	case errors.Is(err, errNonCompliant):
+		return exitNonCompliant
+	default:
+		fmt.Fprintf(stderr, "%s\n", err)
+		return exitError
+	}
+}
+
+//usageError is an error in how a command was invoked
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+//errNonCompliant is returned by audit if any key breaches the policy
+var errNonCompliant = errors.New("keys breach the rotation policy")
+
+//command holds a subcommand's flags and output streams
+type command struct {
+	name   string
+	flags  *flag.FlagSet
+	stdout io.Writer
+	stderr io.Writer
+
+	config          string
+	provider        string
+	scope           string
+	region          string
+	endpoint        string
+	credentials     string
+	roleArn         string
+	accounts        string
+	excludeAccounts string
+	includeInactive bool
+	allowPartial    bool
+	output          string
+	account         string
+	keyID           string
+	dryRun          bool
+	disable         bool
+	verify          bool
+	out             string
+	failOn          string
+}
+
+//newCommand returns the named subcommand with its flags defined
+func newCommand(name string, stdout, stderr io.Writer) *command {
+	cmd := &command{name: name, stdout: stdout, stderr: stderr}
+	flags := flag.NewFlagSet("cloud-key-client "+name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&cmd.config, "config", "", "YAML or JSON config file of providers, filters and policy")
+	flags.StringVar(&cmd.provider, "provider", "", "provider name (aws, gcp, aiven); selects from the config's providers if --config is set")
+	flags.StringVar(&cmd.scope, "scope", "", "provider scope, e.g. a GCP project, or organizations/ID or folders/ID")
+	flags.StringVar(&cmd.region, "region", "", "provider region (AWS); not allowed with --config")
+	flags.StringVar(&cmd.endpoint, "endpoint", "", "override the provider's API endpoint; not allowed with --config")
+	flags.StringVar(&cmd.credentials, "credentials", "", "provider credentials reference, env:NAME or file:PATH; not allowed with --config")
+	flags.StringVar(&cmd.roleArn, "role-arn", "", "IAM role to assume (AWS); not allowed with --config")
+	flags.StringVar(&cmd.output, "output", "table", "output format: table, json or csv")
+	switch name {
+	case "list", "audit":
+		flags.StringVar(&cmd.accounts, "accounts", "", "comma-separated account patterns to keep, e.g. ci-*")
+		flags.StringVar(&cmd.excludeAccounts, "exclude-accounts", "", "comma-separated account patterns to drop")
+		flags.BoolVar(&cmd.includeInactive, "include-inactive", false, "include inactive keys")
+		flags.BoolVar(&cmd.allowPartial, "allow-partial", false,
+			"succeed with the keys that could be collected if some providers fail (but not all of them)")
+	default:
+		flags.StringVar(&cmd.account, "account", "", "the key's account: its FULL ACCOUNT as listed, which is PREFIX:DESCRIPTION for aiven")
+		flags.BoolVar(&cmd.dryRun, "dry-run", false, "show what would be done, without doing it")
+	}
+	switch name {
+	case "delete", "rotate":
+		flags.StringVar(&cmd.keyID, "key-id", "", "the ID of the key")
+	case "audit":
+		flags.StringVar(&cmd.failOn, "fail-on", string(keys.PolicyOverdue),
+			"exit with status 3 if any key is this status or worse: overdue, due-for-rotation or none")
+	}
+	if name == "create" || name == "rotate" {
+		flags.StringVar(&cmd.out, "out", "", "write the new credential to this file (mode 0600) as JSON, or a binary key (e.g. PKCS#12) as is, rather than stdout")
+	}
+	if name == "rotate" {
+		flags.BoolVar(&cmd.disable, "disable", false, "disable the old key, rather than deleting it")
+		flags.BoolVar(&cmd.verify, "verify", false, "check the new key authenticates before retiring the old key")
+	}
+	cmd.flags = flags
+	return cmd
+}
+
+//loadConfig returns the config to run with: the config file if one is set
+//(limited to --provider, if it's set too), or a config of the single
+//provider described by the flags. Flags describing a provider can't be
+//combined with a config file, rather than being silently ignored
+func (c *command) loadConfig() (config keys.Config, err error) {
+	if c.config != "" {
+		if c.region != "" || c.endpoint != "" || c.credentials != "" || c.roleArn != "" {
+			err = usageError("--region, --endpoint, --credentials and --role-arn can't be combined with --config; " +
+				"set them on the provider in the config file")
+			return
+		}
+		if config, err = keys.LoadConfig(c.config); err != nil {
+			return
+		}
+		if c.provider != "" {
+			var providers []keys.Provider
+			for _, provider := range config.Providers {
+				if provider.Provider == c.provider && (c.scope == "" || provider.Scope() == c.scope) {
+					providers = append(providers, provider)
+				}
+			}
+			config.Providers = providers
+		}
+	} else {
+		if c.provider == "" {
+			err = usageError("--config or --provider needs to be set")
+			return
+		}
+		config.Providers = []keys.Provider{{
+			Provider: c.provider,
+			AwsRole:  keys.AwsRole{RoleArn: c.roleArn},
+			Options: keys.ProviderOptions{
+				Scope:       c.scope,
+				Region:      c.region,
+				Endpoint:    c.endpoint,
+				Credentials: c.credentials,
+			},
+		}}
+	}
+	if c.includeInactive {
+		config.Filter.IncludeInactiveKeys = true
+	}
+	config.Filter.Accounts = append(config.Filter.Accounts, splitList(c.accounts)...)
+	config.Filter.ExcludeAccounts = append(config.Filter.ExcludeAccounts, splitList(c.excludeAccounts)...)
+	if len(config.Providers) == 0 {
+		err = usageError("no providers are configured")
+	}
+	return
+}
+
+//singleProvider returns the one provider a key operation is for
+func (c *command) singleProvider() (provider keys.Provider, err error) {
+	var config keys.Config
+	if config, err = c.loadConfig(); err != nil {
+		return
+	}
+	if len(config.Providers) > 1 {
+		err = usageError(fmt.Sprintf("%d providers are configured; select one with --provider (and --scope)",
+			len(config.Providers)))
+		return
+	}
+	return config.Providers[0], nil
+}
+
+//newFormatter returns the formatter for --output
+func (c *command) newFormatter() (formatter, error) {
+	switch c.output {
+	case "table":
+		return newTableFormatter(c.stdout), nil
+	case "json":
+		return newJSONFormatter(c.stdout), nil
+	case "csv":
+		return newCSVFormatter(c.stdout), nil
+	}
+	return nil, usageError(fmt.Sprintf("unknown output format %q, expected table, json or csv", c.output))
+}
+
+//collectKeys returns the filtered keys of every configured provider. Keys
+//from providers that could be reached are returned even if others failed,
+//along with an error unless --allow-partial is set and at least one provider
+//succeeded, so a run that missed keys isn't mistaken for a clean one
+func (c *command) collectKeys(ctx context.Context, config keys.Config) ([]keys.Key, error) {
+	allKeys, err := keys.KeysWithOptions(ctx, config.Providers, config.Filter.KeysOptions())
+	var providerErrs keys.ProviderErrors
+	if !errors.As(err, &providerErrs) {
+		return config.Filter.Filter(allKeys), err
+	}
+	for _, providerErr := range providerErrs {
+		fmt.Fprintf(c.stderr, "warning: %s\n", providerErr)
+	}
+	allFailed := len(providerErrs) == len(config.Providers) && len(allKeys) == 0
+	if c.allowPartial && !allFailed {
+		err = nil
+	} else {
+		err = fmt.Errorf("keys couldn't be collected from %d of %d provider(s)", len(providerErrs), len(config.Providers))
+	}
+	return config.Filter.Filter(allKeys), err
+}
+
+//runList lists keys
+func runList(ctx context.Context, cmd *command) error {
+	formatter, err := cmd.newFormatter()
+	if err != nil {
+		return err
+	}
+	config, err := cmd.loadConfig()
+	if err != nil {
+		return err
+	}
+	// the keys that could be collected are listed even if some providers
+	// failed
+	allKeys, collectErr := cmd.collectKeys(ctx, config)
+	if err = formatter.keys(allKeys); err != nil {
+		return err
+	}
+	return collectErr
+}
+
+//runAudit classifies keys against the config's rotation policy
+func runAudit(ctx context.Context, cmd *command) error {
+	formatter, err := cmd.newFormatter()
+	if err != nil {
+		return err
+	}
+	failOn, err := failOnStatuses(cmd.failOn)
+	if err != nil {
+		return err
+	}
+	config, err := cmd.loadConfig()
+	if err != nil {
+		return err
+	}
+	if len(config.Policy.Rules) == 0 {
+		return usageError("audit needs a --config with policy rules")
+	}
+	allKeys, collectErr := cmd.collectKeys(ctx, config)
+	evaluations := config.Policy.Evaluate(allKeys)
+	if err = formatter.evaluations(evaluations); err != nil {
+		return err
+	}
+	// keys that couldn't be collected may breach the policy, so the audit
+	// fails rather than reporting compliance
+	if collectErr != nil {
+		return collectErr
+	}
+	for _, evaluation := range evaluations {
+		if failOn[evaluation.Status] {
+			return errNonCompliant
+		}
+	}
+	return nil
+}
+
+//failOnStatuses returns the statuses that --fail-on makes audit fail on
+func failOnStatuses(failOn string) (map[keys.PolicyStatus]bool, error) {
+	switch keys.PolicyStatus(failOn) {
+	case keys.PolicyOverdue:
+		return map[keys.PolicyStatus]bool{keys.PolicyOverdue: true}, nil
+	case keys.PolicyDue:
+		return map[keys.PolicyStatus]bool{keys.PolicyOverdue: true, keys.PolicyDue: true}, nil
+	case "none":
+		return nil, nil
+	}
+	return nil, usageError(fmt.Sprintf("unknown --fail-on status %q", failOn))
+}
+
+//runCreate creates a key
+func runCreate(ctx context.Context, cmd *command) error {
+	if cmd.account == "" {
+		return usageError("--account needs to be set")
+	}
+	formatter, err := cmd.newFormatter()
+	if err != nil {
+		return err
+	}
+	provider, err := cmd.singleProvider()
+	if err != nil {
+		return err
+	}
+	if _, err = cmd.keyAccount(provider); err != nil {
+		return err
+	}
+	if cmd.dryRun {
+		fmt.Fprintf(cmd.stdout, "would create a key in %s account %s\n", describe(provider), cmd.account)
+		return nil
+	}
+	credential, err := keys.CreateCredentialWithContext(ctx, provider, cmd.account)
+	if err != nil {
+		return err
+	}
+	return cmd.deliver(formatter, credential)
+}
+
+//runDelete deletes a key
+func runDelete(ctx context.Context, cmd *command) error {
+	key, err := cmd.existingKey()
+	if err != nil {
+		return err
+	}
+	if cmd.dryRun {
+		fmt.Fprintf(cmd.stdout, "would delete key %s from %s account %s\n", key.ID, describe(key.Provider), key.FullAccount)
+		return nil
+	}
+	if err = keys.DeleteKeyWithContext(ctx, key); err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.stderr, "deleted key %s\n", key.ID)
+	return nil
+}
+
+//runRotate replaces a key with a new one
+func runRotate(ctx context.Context, cmd *command) error {
+	formatter, err := cmd.newFormatter()
+	if err != nil {
+		return err
+	}
+	key, err := cmd.existingKey()
+	if err != nil {
+		return err
+	}
+	retire, retired := "delete", "deleted"
+	if cmd.disable {
+		retire, retired = "disable", "disabled"
+	}
+	if cmd.dryRun {
+		verify := ""
+		if cmd.verify {
+			verify = ", verify it"
+		}
+		fmt.Fprintf(cmd.stdout, "would create a key in %s account %s, deliver it%s, then %s key %s\n",
+			describe(key.Provider), key.FullAccount, verify, retire, key.ID)
+		return nil
+	}
+	opts := keys.RotateOptions{
+		Deliver: func(ctx context.Context, credential keys.Credential) error {
+			return cmd.deliver(formatter, credential)
+		},
+		DisableOldKey: cmd.disable,
+	}
+	if cmd.verify {
+		opts.Verify = func(ctx context.Context, credential keys.Credential) error {
+			identity, err := keys.VerifyKeyWithContext(ctx, key.Provider, credential)
+			if err != nil {
+				return err
+			}
+			//an Aiven identity's Account is the token description, as the
+			//prefix in its FullAccount differs between the old and new keys
+			account := key.FullAccount
+			if key.Provider.Provider == aivenProviderName {
+				account = key.Account
+			}
+			if identity.Account != account {
+				return fmt.Errorf("new key authenticates as account %s, not %s", identity.Account, account)
+			}
+			fmt.Fprintf(cmd.stderr, "verified new key authenticates as %s\n", identity.ID)
+			return nil
+		}
+	}
+	credential, err := keys.RotateWithContext(ctx, key, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.stderr, "rotated key %s to %s (old key %s)\n", key.ID, credential.KeyID, retired)
+	return nil
+}
+
+//existingKey returns the key identified by --account and --key-id
+func (c *command) existingKey() (key keys.Key, err error) {
+	if c.account == "" || c.keyID == "" {
+		err = usageError("--account and --key-id need to be set")
+		return
+	}
+	if key.Provider, err = c.singleProvider(); err != nil {
+		return
+	}
+	if key.Account, err = c.keyAccount(key.Provider); err != nil {
+		return
+	}
+	key.FullAccount = c.account
+	key.ID = c.keyID
+	return
+}
+
+//keyAccount returns the Account of a key whose FullAccount is --account:
+//the description of an Aiven PREFIX:DESCRIPTION, or --account itself for
+//other providers
+func (c *command) keyAccount(provider keys.Provider) (string, error) {
+	if provider.Provider != aivenProviderName {
+		return c.account, nil
+	}
+	_, description, found := strings.Cut(c.account, aivenAccountSeparator)
+	if !found {
+		return "", usageError(fmt.Sprintf("aiven --account needs to be PREFIX%sDESCRIPTION, as listed in FULL ACCOUNT",
+			aivenAccountSeparator))
+	}
+	return description, nil
+}
+
+//deliver writes a new credential to --out, or stdout if it isn't set. A
+//binary secret, e.g. a GCP PKCS#12 file, is written to --out as it is, and
+//the credential as JSON otherwise
+func (c *command) deliver(formatter formatter, credential keys.Credential) error {
+	if c.out == "" {
+		return formatter.credential(credential)
+	}
+	file, err := os.OpenFile(c.out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if isBinarySecret(credential) {
+		_, err = io.WriteString(file, credential.Secret)
+	} else {
+		err = newJSONFormatter(file).credential(credential)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stderr, "wrote new key %s to %s\n", credential.KeyID, c.out)
+	return nil
+}
+
+//describe names a provider and its scope, if it has one
+func describe(provider keys.Provider) string {
+	if scope := provider.Scope(); scope != "" {
+		return fmt.Sprintf("%s (%s)", provider.Provider, scope)
+	}
+	return provider.Provider
+}
+
+//splitList splits a comma-separated flag value, dropping empty items
+func splitList(value string) (items []string) {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	keys "github.com/ovotech/cloud-key-client"
+)
+
+const (
+	testProviderName      = "fake"
+	failingProviderName   = "failing"
+	verifyingProviderName = "verifying"
+)
+
+//fakeProvider serves a fixed set of keys, and records the key operations
+//made through it
+type fakeProvider struct {
+	keys  []keys.Key
+	calls *[]string
+	// newKey is the secret of created keys, "secret" if it's empty
+	newKey string
+}
+
+func (f fakeProvider) KeysWithContext(ctx context.Context, provider keys.Provider, includeInactiveKeys bool) (providerKeys []keys.Key, err error) {
+	for _, key := range f.keys {
+		if includeInactiveKeys || key.Status == "Active" {
+			key.Provider = provider
+			providerKeys = append(providerKeys, key)
+		}
+	}
+	return
+}
+
+func (f fakeProvider) CreateKeyWithContext(ctx context.Context, provider keys.Provider, account string) (string, string, error) {
+	*f.calls = append(*f.calls, "create "+account)
+	if f.newKey != "" {
+		return "new", f.newKey, nil
+	}
+	return "new", "secret", nil
+}
+
+func (f fakeProvider) DeleteKeyWithContext(ctx context.Context, key keys.Key) error {
+	*f.calls = append(*f.calls, "delete "+key.FullAccount+" "+key.ID)
+	return nil
+}
+
+func (f fakeProvider) DisableKeyWithContext(ctx context.Context, key keys.Key) error {
+	*f.calls = append(*f.calls, "disable "+key.FullAccount+" "+key.ID)
+	return nil
+}
+
+func (f fakeProvider) EnableKeyWithContext(ctx context.Context, key keys.Key) error {
+	return nil
+}
+
+//failingProvider fails to list keys, e.g. as its credentials have expired
+type failingProvider struct {
+	fakeProvider
+}
+
+func (f failingProvider) KeysWithContext(ctx context.Context, provider keys.Provider, includeInactiveKeys bool) ([]keys.Key, error) {
+	return nil, &keys.KeyError{Kind: keys.ErrPermissionDenied, Msg: "expired credentials"}
+}
+
+//verifyingProvider verifies every credential as belonging to account
+type verifyingProvider struct {
+	fakeProvider
+	account string
+}
+
+func (v verifyingProvider) VerifyKeyWithContext(ctx context.Context, provider keys.Provider, credential keys.Credential) (keys.Identity, error) {
+	return keys.Identity{Account: v.account, ID: "id-" + v.account}, nil
+}
+
+var fakeKeys = []keys.Key{
+	{Account: "ci-deploy", FullAccount: "ci-deploy", ID: "old", Age: 100 * 1440, Status: "Active"},
+	{Account: "ci-deploy", FullAccount: "ci-deploy", ID: "older", Age: 200 * 1440, Status: "Inactive"},
+	{Account: "app", FullAccount: "app", ID: "app-key", Age: 10 * 1440, LifeRemaining: 5 * 1440, Status: "Active"},
+}
+
+//runFake runs the command with args against the fake provider, returning
+//its exit status, output and the calls made to the provider
+func runFake(t *testing.T, args ...string) (status int, stdout, stderr string, calls []string) {
+	t.Helper()
+	keys.RegisterProviderWithContext(testProviderName, fakeProvider{keys: fakeKeys, calls: &calls})
+	keys.RegisterProviderWithContext(failingProviderName, failingProvider{})
+	keys.RegisterProviderWithContext(verifyingProviderName, verifyingProvider{fakeProvider{calls: &calls}, "app"})
+	var outBuf, errBuf bytes.Buffer
+	status = run(context.Background(), args, &outBuf, &errBuf)
+	return status, outBuf.String(), errBuf.String(), calls
+}
+
+var listTests = []struct {
+	args []string
+	ids  []string
+}{
+	{[]string{"list", "--provider", testProviderName, "--output", "json"}, []string{"app-key", "old"}},
+	{[]string{"list", "--provider", testProviderName, "--output", "json", "--include-inactive"}, []string{"app-key", "old", "older"}},
+	{[]string{"list", "--provider", testProviderName, "--output", "json", "--accounts", "ci-*"}, []string{"old"}},
+	{[]string{"list", "--provider", testProviderName, "--output", "json", "--exclude-accounts", "ci-*,other"}, []string{"app-key"}},
+}
+
+func TestList(t *testing.T) {
+	for _, test := range listTests {
+		status, stdout, stderr, _ := runFake(t, test.args...)
+		if status != exitOK {
+			t.Errorf("%v: got status %d (%s), want %d", test.args, status, stderr, exitOK)
+			continue
+		}
+		var listed []jsonKey
+		if err := json.Unmarshal([]byte(stdout), &listed); err != nil {
+			t.Errorf("%v: unexpected error decoding output: %s", test.args, err)
+			continue
+		}
+		var ids []string
+		for _, key := range listed {
+			ids = append(ids, key.ID)
+		}
+		if !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("%v: got key IDs %v, want %v", test.args, ids, test.ids)
+		}
+	}
+}
+
+func TestListTable(t *testing.T) {
+	_, stdout, _, _ := runFake(t, "list", "--provider", testProviderName)
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want a header and 2 keys:\n%s", len(lines), stdout)
+	}
+	expected := []string{"fake", "app", "app", "app-key", "Active", "10", "5", "-"}
+	if fields := strings.Fields(lines[1]); !reflect.DeepEqual(fields, expected) {
+		t.Errorf("got row %v, want %v", fields, expected)
+	}
+}
+
+func TestListCSV(t *testing.T) {
+	_, stdout, _, _ := runFake(t, "list", "--provider", testProviderName, "--output", "csv")
+	records, err := csv.NewReader(strings.NewReader(stdout)).ReadAll()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(records) != 3 || !reflect.DeepEqual(records[0], keyColumns) {
+		t.Fatalf("got records %v, want a header and 2 keys", records)
+	}
+	expected := []string{"fake", "", "", "ci-deploy", "ci-deploy", "old", "Active", "100", "-", "-"}
+	if !reflect.DeepEqual(records[2], expected) {
+		t.Errorf("got record %v, want %v", records[2], expected)
+	}
+}
+
+func TestKeyOutput(t *testing.T) {
+	key := keys.Key{
+		Provider: keys.Provider{Provider: "aws", AwsRole: keys.AwsRole{AccountID: "123456789012"}},
+		Account:  "ci-deploy", FullAccount: "ci-deploy", ID: "AKIA", Status: "Active",
+		LastUsedIP: "192.0.2.1", LastUsedUserAgent: "curl/8.0",
+	}
+	expected := []string{"aws", "", "123456789012", "ci-deploy", "ci-deploy", "AKIA", "Active", "0", "-", "-"}
+	if row := keyRow(key); !reflect.DeepEqual(row, expected) {
+		t.Errorf("got row %v, want %v", row, expected)
+	}
+	jk := newJSONKey(key)
+	if jk.AwsAccountID != "123456789012" || jk.LastUsedIP != "192.0.2.1" || jk.LastUsedUserAgent != "curl/8.0" {
+		t.Errorf("got JSON key %+v, want its AWS account and last used IP and user agent", jk)
+	}
+}
+
+var keyOperationTests = []struct {
+	args  []string
+	calls []string
+}{
+	{[]string{"create", "--account", "app"}, []string{"create app"}},
+	{[]string{"create", "--account", "app", "--dry-run"}, nil},
+	{[]string{"delete", "--account", "app", "--key-id", "app-key"}, []string{"delete app app-key"}},
+	{[]string{"delete", "--account", "app", "--key-id", "app-key", "--dry-run"}, nil},
+	{[]string{"rotate", "--account", "app", "--key-id", "app-key"}, []string{"create app", "delete app app-key"}},
+	{[]string{"rotate", "--account", "app", "--key-id", "app-key", "--disable"}, []string{"create app", "disable app app-key"}},
+	{[]string{"rotate", "--account", "app", "--key-id", "app-key", "--dry-run"}, nil},
+}
+
+func TestKeyOperations(t *testing.T) {
+	for _, test := range keyOperationTests {
+		args := append(test.args, "--provider", testProviderName)
+		status, stdout, stderr, calls := runFake(t, args...)
+		if status != exitOK {
+			t.Errorf("%v: got status %d (%s), want %d", test.args, status, stderr, exitOK)
+		}
+		if !reflect.DeepEqual(calls, test.calls) {
+			t.Errorf("%v: got calls %v, want %v", test.args, calls, test.calls)
+		}
+		if len(test.calls) == 0 && !strings.HasPrefix(stdout, "would ") {
+			t.Errorf("%v: got output %q, want a description of what would be done", test.args, stdout)
+		}
+	}
+}
+
+func TestRotateOut(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "credential.json")
+	status, stdout, stderr, _ := runFake(t, "rotate", "--provider", testProviderName,
+		"--account", "app", "--key-id", "app-key", "--out", out)
+	if status != exitOK {
+		t.Fatalf("got status %d (%s), want %d", status, stderr, exitOK)
+	}
+	if stdout != "" {
+		t.Errorf("got output %q, want the credential to only be written to the file", stdout)
+	}
+	info, err := os.Stat(out)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("got mode %v, want 0600", info.Mode().Perm())
+	}
+	data, _ := ioutil.ReadFile(out)
+	var credential jsonCredential
+	if err = json.Unmarshal(data, &credential); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := jsonCredential{Provider: testProviderName, KeyID: "new", Secret: "secret"}
+	if !reflect.DeepEqual(credential, expected) {
+		t.Errorf("got credential %+v, want %+v", credential, expected)
+	}
+}
+
+func TestBinarySecret(t *testing.T) {
+	// e.g. the start of a PKCS#12 file, which isn't valid UTF-8
+	secret := "\x30\x82\x09\xff\xfe"
+	var calls []string
+	keys.RegisterProviderWithContext("binary", fakeProvider{calls: &calls, newKey: secret})
+	var stdout, stderr bytes.Buffer
+	if status := run(context.Background(), []string{"create", "--provider", "binary", "--account", "app", "--output", "json"},
+		&stdout, &stderr); status != exitOK {
+		t.Fatalf("got status %d (%s), want %d", status, stderr.String(), exitOK)
+	}
+	var credential jsonCredential
+	if err := json.Unmarshal(stdout.Bytes(), &credential); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(credential.Secret)
+	if err != nil || credential.SecretEncoding != base64Encoding || string(decoded) != secret {
+		t.Errorf("got secret %q encoded as %q, want %q base64 encoded", credential.Secret, credential.SecretEncoding, secret)
+	}
+
+	out := filepath.Join(t.TempDir(), "key.p12")
+	if status := run(context.Background(), []string{"create", "--provider", "binary", "--account", "app", "--out", out},
+		&stdout, &stderr); status != exitOK {
+		t.Fatalf("got status %d (%s), want %d", status, stderr.String(), exitOK)
+	}
+	if data, _ := ioutil.ReadFile(out); string(data) != secret {
+		t.Errorf("got file contents %q, want the raw secret %q", data, secret)
+	}
+}
+
+const testAuditConfig = `providers:
+  - provider: fake
+policy:
+  rules:
+    - account: "ci-*"
+      maxAge: %s
+      dueWithin: 10d
+`
+
+var auditTests = []struct {
+	maxAge string
+	failOn string
+	status int
+}{
+	{"90d", "overdue", exitNonCompliant},
+	{"90d", "none", exitOK},
+	{"120d", "overdue", exitOK},
+	{"120d", "due-for-rotation", exitOK},
+	{"105d", "due-for-rotation", exitNonCompliant},
+}
+
+func TestAudit(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config.yaml")
+	for _, test := range auditTests {
+		data := strings.Replace(testAuditConfig, "%s", test.maxAge, 1)
+		if err := ioutil.WriteFile(config, []byte(data), 0600); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		status, stdout, stderr, _ := runFake(t, "audit", "--config", config, "--fail-on", test.failOn, "--output", "json")
+		if status != test.status {
+			t.Errorf("maxAge %s, fail on %s: got status %d (%s), want %d",
+				test.maxAge, test.failOn, status, stderr, test.status)
+		}
+		var evaluations []jsonEvaluation
+		if err := json.Unmarshal([]byte(stdout), &evaluations); err != nil || len(evaluations) != 2 {
+			t.Errorf("maxAge %s: got output %q, want 2 evaluations", test.maxAge, stdout)
+		}
+	}
+}
+
+var failingProviderTests = []struct {
+	args   []string
+	status int
+}{
+	{[]string{"list", "--provider", failingProviderName}, exitError},
+	{[]string{"list", "--provider", failingProviderName, "--allow-partial"}, exitError},
+	{[]string{"list", "--config", "both"}, exitError},
+	{[]string{"list", "--config", "both", "--allow-partial"}, exitOK},
+	{[]string{"audit", "--config", "both", "--fail-on", "none"}, exitError},
+	{[]string{"audit", "--config", "both", "--fail-on", "none", "--allow-partial"}, exitOK},
+	{[]string{"audit", "--config", "both", "--allow-partial"}, exitNonCompliant},
+}
+
+func TestFailingProviders(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config.yaml")
+	data := "providers:\n  - provider: fake\n  - provider: failing\npolicy:\n  rules:\n    - maxAge: 90d\n"
+	if err := ioutil.WriteFile(config, []byte(data), 0600); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, test := range failingProviderTests {
+		args := append([]string{}, test.args...)
+		for i, arg := range args {
+			if arg == "both" {
+				args[i] = config
+			}
+		}
+		status, stdout, stderr, _ := runFake(t, args...)
+		if status != test.status {
+			t.Errorf("%v: got status %d (%s), want %d", test.args, status, stderr, test.status)
+		}
+		if !strings.Contains(stderr, "expired credentials") {
+			t.Errorf("%v: got stderr %q, want a warning about the failing provider", test.args, stderr)
+		}
+		if test.args[1] == "--config" && !strings.Contains(stdout, "app-key") {
+			t.Errorf("%v: got output %q, want the keys that could be collected", test.args, stdout)
+		}
+	}
+}
+
+var usageTests = [][]string{
+	nil,
+	{"unknown"},
+	{"list"},
+	{"list", "--provider", testProviderName, "--output", "xml"},
+	{"create", "--provider", testProviderName},
+	{"delete", "--provider", testProviderName, "--account", "app"},
+	{"audit", "--provider", testProviderName},
+	{"list", "--no-such-flag"},
+	{"list", "--config", "keys.yaml", "--role-arn", "arn:aws:iam::123456789012:role/other"},
+	{"create", "--config", "keys.yaml", "--provider", "aws", "--region", "us-east-1", "--account", "app"},
+	{"rotate", "--provider", "aiven", "--credentials", "env:AIVEN_TOKEN", "--account", "ci-deploy", "--key-id", "abc123"},
+}
+
+func TestUsage(t *testing.T) {
+	for _, args := range usageTests {
+		if status, _, _, calls := runFake(t, args...); status != exitUsage || len(calls) != 0 {
+			t.Errorf("%v: got status %d and calls %v, want %d and no calls", args, status, calls, exitUsage)
+		}
+	}
+}
+
+func TestRotateVerify(t *testing.T) {
+	status, _, stderr, calls := runFake(t, "rotate", "--provider", verifyingProviderName,
+		"--account", "app", "--key-id", "app-key", "--verify")
+	if expected := []string{"create app", "delete app app-key"}; status != exitOK || !reflect.DeepEqual(calls, expected) {
+		t.Errorf("got status %d (%s) and calls %v, want %d and %v", status, stderr, calls, exitOK, expected)
+	}
+
+	status, _, stderr, calls = runFake(t, "rotate", "--provider", verifyingProviderName,
+		"--account", "other", "--key-id", "other-key", "--verify")
+	if status != exitError || !strings.Contains(stderr, "authenticates as account app, not other") {
+		t.Errorf("got status %d (%s), want %d and an account mismatch error", status, stderr, exitError)
+	}
+	for _, call := range calls {
+		if strings.HasSuffix(call, " other-key") {
+			t.Errorf("got call %q, want the old key kept when the new one is for another account", call)
+		}
+	}
+}
+
+func TestAivenAccount(t *testing.T) {
+	status, stdout, stderr, _ := runFake(t, "rotate", "--provider", "aiven", "--credentials", "env:AIVEN_TOKEN",
+		"--account", "abc123:ci-deploy", "--key-id", "abc123", "--dry-run")
+	if status != exitOK || !strings.Contains(stdout, "account abc123:ci-deploy") {
+		t.Errorf("got status %d and output %q (%s), want %d and the key's full account", status, stdout, stderr, exitOK)
+	}
+}
+
+func TestUnknownProvider(t *testing.T) {
+	status, _, stderr, _ := runFake(t, "create", "--provider", "nope", "--account", "app")
+	if status != exitError || !strings.Contains(stderr, "nope") {
+		t.Errorf("got status %d (%s), want %d and an unknown provider error", status, stderr, exitError)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	keys "github.com/ovotech/cloud-key-client"
+)
+
+//formatter writes command results in one of the --output formats
+type formatter interface {
+	keys(keys []keys.Key) error
+	evaluations(evaluations []keys.KeyEvaluation) error
+	credential(credential keys.Credential) error
+}
+
+//keyColumns are the columns of list output
+var keyColumns = []string{"PROVIDER", "SCOPE", "AWS ACCOUNT", "ACCOUNT", "FULL ACCOUNT", "ID", "STATUS",
+	"AGE DAYS", "LIFE REMAINING DAYS", "LAST USED"}
+
+//evaluationColumns are the columns of audit output
+var evaluationColumns = []string{"PROVIDER", "SCOPE", "AWS ACCOUNT", "ACCOUNT", "ID", "AGE DAYS", "POLICY", "REASONS"}
+
+//keyRow returns a key's list columns
+func keyRow(key keys.Key) []string {
+	return []string{key.Provider.Provider, key.Provider.Scope(), key.Provider.AwsRole.AccountID, key.Account,
+		key.FullAccount, key.ID, key.Status, minutesAsDays(key.Age), lifeRemaining(key.LifeRemaining),
+		lastUsed(key.LastUsed)}
+}
+
+//evaluationRow returns an evaluation's audit columns
+func evaluationRow(evaluation keys.KeyEvaluation) []string {
+	key := evaluation.Key
+	return []string{key.Provider.Provider, key.Provider.Scope(), key.Provider.AwsRole.AccountID, key.Account, key.ID,
+		minutesAsDays(key.Age), string(evaluation.Status), strings.Join(evaluation.Reasons, "; ")}
+}
+
+//minutesAsDays formats a number of minutes in whole days
+func minutesAsDays(minutes float64) string {
+	return strconv.Itoa(int(minutes / 1440))
+}
+
+//lifeRemaining formats a key's life remaining in whole days, or "-" if it
+//doesn't expire
+func lifeRemaining(minutes float64) string {
+	if minutes == 0 {
+		return "-"
+	}
+	return minutesAsDays(minutes)
+}
+
+//lastUsed formats when a key was last used, or "-" if it's unknown
+func lastUsed(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+//base64Encoding is the SECRET ENCODING of secrets that are base64 encoded
+const base64Encoding = "base64"
+
+//isBinarySecret reports whether a credential's secret is binary rather than
+//text, e.g. a GCP PKCS#12 file, so it can't be output as is
+func isBinarySecret(credential keys.Credential) bool {
+	if credential.Secret == "" {
+		return false
+	}
+	return (credential.Provider == "gcp" && credential.ServiceAccount == nil) || !utf8.ValidString(credential.Secret)
+}
+
+//encodedSecret returns a credential's secret as text, and how it's encoded:
+//binary secrets are base64 encoded, and text secrets are left as they are
+func encodedSecret(credential keys.Credential) (secret, encoding string) {
+	if isBinarySecret(credential) {
+		return base64.StdEncoding.EncodeToString([]byte(credential.Secret)), base64Encoding
+	}
+	return credential.Secret, ""
+}
+
+//credentialFields returns a credential's fields, in output order
+func credentialFields(credential keys.Credential) [][2]string {
+	secret, encoding := encodedSecret(credential)
+	return [][2]string{
+		{"PROVIDER", credential.Provider},
+		{"KEY ID", credential.KeyID},
+		{"SECRET", secret},
+		{"SECRET ENCODING", encoding},
+	}
+}
+
+//tableFormatter writes aligned columns
+type tableFormatter struct {
+	w *tabwriter.Writer
+}
+
+func newTableFormatter(w io.Writer) tableFormatter {
+	return tableFormatter{w: tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)}
+}
+
+func (f tableFormatter) keys(keys []keys.Key) error {
+	f.row(keyColumns)
+	for _, key := range keys {
+		f.row(keyRow(key))
+	}
+	return f.w.Flush()
+}
+
+func (f tableFormatter) evaluations(evaluations []keys.KeyEvaluation) error {
+	f.row(evaluationColumns)
+	for _, evaluation := range evaluations {
+		f.row(evaluationRow(evaluation))
+	}
+	return f.w.Flush()
+}
+
+//credential writes one field per line, as a multi-line secret (e.g. GCP
+//service account JSON) wouldn't fit in a table
+func (f tableFormatter) credential(credential keys.Credential) error {
+	for _, field := range credentialFields(credential) {
+		if field[1] != "" {
+			fmt.Fprintf(f.w, "%s:\t%s\n", field[0], field[1])
+		}
+	}
+	return f.w.Flush()
+}
+
+func (f tableFormatter) row(columns []string) {
+	fmt.Fprintln(f.w, strings.Join(columns, "\t"))
+}
+
+//csvFormatter writes comma-separated values, with a header row
+type csvFormatter struct {
+	w *csv.Writer
+}
+
+func newCSVFormatter(w io.Writer) csvFormatter {
+	return csvFormatter{w: csv.NewWriter(w)}
+}
+
+func (f csvFormatter) keys(keys []keys.Key) error {
+	f.w.Write(keyColumns)
+	for _, key := range keys {
+		f.w.Write(keyRow(key))
+	}
+	f.w.Flush()
+	return f.w.Error()
+}
+
+func (f csvFormatter) evaluations(evaluations []keys.KeyEvaluation) error {
+	f.w.Write(evaluationColumns)
+	for _, evaluation := range evaluations {
+		f.w.Write(evaluationRow(evaluation))
+	}
+	f.w.Flush()
+	return f.w.Error()
+}
+
+func (f csvFormatter) credential(credential keys.Credential) error {
+	var header, row []string
+	for _, field := range credentialFields(credential) {
+		header = append(header, field[0])
+		row = append(row, field[1])
+	}
+	f.w.Write(header)
+	f.w.Write(row)
+	f.w.Flush()
+	return f.w.Error()
+}
+
+//jsonFormatter writes indented JSON
+type jsonFormatter struct {
+	enc *json.Encoder
+}
+
+func newJSONFormatter(w io.Writer) jsonFormatter {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return jsonFormatter{enc: enc}
+}
+
+//jsonKey is the JSON form of a key; the provider's credentials are
+//deliberately left out
+type jsonKey struct {
+	Provider             string            `json:"provider"`
+	Scope                string            `json:"scope,omitempty"`
+	AwsAccountID         string            `json:"awsAccountId,omitempty"`
+	Account              string            `json:"account"`
+	FullAccount          string            `json:"fullAccount"`
+	ID                   string            `json:"id"`
+	Name                 string            `json:"name,omitempty"`
+	Status               string            `json:"status"`
+	AgeMinutes           float64           `json:"ageMinutes"`
+	LifeRemainingMinutes float64           `json:"lifeRemainingMinutes,omitempty"`
+	LastUsed             *time.Time        `json:"lastUsed,omitempty"`
+	LastUsedService      string            `json:"lastUsedService,omitempty"`
+	LastUsedRegion       string            `json:"lastUsedRegion,omitempty"`
+	LastUsedIP           string            `json:"lastUsedIP,omitempty"`
+	LastUsedUserAgent    string            `json:"lastUsedUserAgent,omitempty"`
+	Metadata             map[string]string `json:"metadata,omitempty"`
+}
+
+//jsonEvaluation is the JSON form of a key's policy evaluation
+type jsonEvaluation struct {
+	Key     jsonKey  `json:"key"`
+	Status  string   `json:"status"`
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+//jsonCredential is the JSON form of a new key
+type jsonCredential struct {
+	Provider string `json:"provider"`
+	KeyID    string `json:"keyId"`
+	Secret   string `json:"secret"`
+	//SecretEncoding is "base64" if Secret is a base64 encoded binary secret
+	SecretEncoding string            `json:"secretEncoding,omitempty"`
+	EnvVars        map[string]string `json:"envVars,omitempty"`
+}
+
+func newJSONKey(key keys.Key) jsonKey {
+	jk := jsonKey{
+		Provider:             key.Provider.Provider,
+		Scope:                key.Provider.Scope(),
+		AwsAccountID:         key.Provider.AwsRole.AccountID,
+		Account:              key.Account,
+		FullAccount:          key.FullAccount,
+		ID:                   key.ID,
+		Name:                 key.Name,
+		Status:               key.Status,
+		AgeMinutes:           key.Age,
+		LifeRemainingMinutes: key.LifeRemaining,
+		LastUsedService:      key.LastUsedService,
+		LastUsedRegion:       key.LastUsedRegion,
+		LastUsedIP:           key.LastUsedIP,
+		LastUsedUserAgent:    key.LastUsedUserAgent,
+		Metadata:             key.Metadata,
+	}
+	if !key.LastUsed.IsZero() {
+		lastUsed := key.LastUsed.UTC()
+		jk.LastUsed = &lastUsed
+	}
+	return jk
+}
+
+func (f jsonFormatter) keys(keys []keys.Key) error {
+	jsonKeys := make([]jsonKey, len(keys))
+	for i, key := range keys {
+		jsonKeys[i] = newJSONKey(key)
+	}
+	return f.enc.Encode(jsonKeys)
+}
+
+func (f jsonFormatter) evaluations(evaluations []keys.KeyEvaluation) error {
+	jsonEvaluations := make([]jsonEvaluation, len(evaluations))
+	for i, evaluation := range evaluations {
+		jsonEvaluations[i] = jsonEvaluation{
+			Key:     newJSONKey(evaluation.Key),
+			Status:  string(evaluation.Status),
+			Reasons: evaluation.Reasons,
+		}
+	}
+	return f.enc.Encode(jsonEvaluations)
+}
+
+func (f jsonFormatter) credential(credential keys.Credential) error {
+	secret, encoding := encodedSecret(credential)
+	return f.enc.Encode(jsonCredential{
+		Provider:       credential.Provider,
+		KeyID:          credential.KeyID,
+		Secret:         secret,
+		SecretEncoding: encoding,
+		EnvVars:        credential.EnvVars(),
+	})
+}
@@ -0,0 +1,367 @@
+package keys
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+//Config is the providers, key filter and rotation policy described by a
+//config file, ready to pass to KeysWithOptions and Policy.Evaluate
+type Config struct {
+	Providers []Provider
+	Filter    KeyFilter
+	Policy    Policy
+}
+
+//KeyFilter selects which keys are collected, and from how many providers at
+//once
+type KeyFilter struct {
+	IncludeInactiveKeys bool
+	//MaxConcurrency limits how many providers are collected from at once, as
+	//in KeysOptions
+	MaxConcurrency int
+	//Accounts are path.Match patterns; if any are set, only keys whose
+	//Account or FullAccount matches one of them are kept
+	Accounts []string
+	//ExcludeAccounts are path.Match patterns; keys whose Account or
+	//FullAccount matches any of them are dropped
+	ExcludeAccounts []string
+}
+
+//ErrInvalidConfig is matched by every ConfigError with errors.Is
+var ErrInvalidConfig = errors.New("invalid config")
+
+//ConfigError describes a problem with a config file, and the line it's on
+type ConfigError struct {
+	Line int
+	Msg  string
+	//Kind is ErrInvalidProvider for problems in the providers section, which
+	//the error then also matches with errors.Is
+	Kind error
+}
+
+//Error returns the message, prefixed with the line number if it's known
+func (e *ConfigError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("invalid config: %s", e.Msg)
+	}
+	return fmt.Sprintf("invalid config: line %d: %s", e.Line, e.Msg)
+}
+
+//Is reports whether target is ErrInvalidConfig, or the error's Kind
+func (e *ConfigError) Is(target error) bool {
+	return target == ErrInvalidConfig || (e.Kind != nil && target == e.Kind)
+}
+
+//LoadConfig reads and validates the YAML or JSON config file at filename
+func LoadConfig(filename string) (config Config, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(filename); err != nil {
+		return
+	}
+	return ParseConfig(data)
+}
+
+//ParseConfig parses and validates a YAML or JSON config (JSON is parsed as
+//YAML, which it's a subset of). Every provider must already be registered,
+//and credentials must be "env:NAME" or "file:PATH" references, so secrets
+//aren't kept in config files
+func ParseConfig(data []byte) (config Config, err error) {
+	var doc yaml.Node
+	if err = yaml.Unmarshal(data, &doc); err != nil {
+		err = yamlConfigError(0, strings.TrimPrefix(err.Error(), "yaml: "))
+		return
+	}
+	if len(doc.Content) == 0 {
+		err = &ConfigError{Msg: "the config is empty"}
+		return
+	}
+	err = decodeMapping(doc.Content[0], "the config", configFields{
+		"providers": func(node *yaml.Node) error {
+			return providerConfigError(decodeSequence(node, "providers", func(item *yaml.Node) error {
+				provider, err := decodeProvider(item)
+				config.Providers = append(config.Providers, provider)
+				return err
+			}))
+		},
+		"filter": func(node *yaml.Node) error {
+			return decodeFilter(node, &config.Filter)
+		},
+		"policy": func(node *yaml.Node) error {
+			return decodeMapping(node, "policy", configFields{
+				"rules": func(node *yaml.Node) error {
+					return decodeSequence(node, "policy rules", func(item *yaml.Node) error {
+						rule, err := decodePolicyRule(item)
+						config.Policy.Rules = append(config.Policy.Rules, rule)
+						return err
+					})
+				},
+			})
+		},
+	})
+	if err == nil && len(config.Providers) == 0 {
+		err = &ConfigError{Line: doc.Content[0].Line, Msg: "at least one provider needs to be configured",
+			Kind: ErrInvalidProvider}
+	}
+	return
+}
+
+//providerConfigError marks err, if it's a ConfigError, as a problem with the
+//providers section
+func providerConfigError(err error) error {
+	var configErr *ConfigError
+	if errors.As(err, &configErr) {
+		configErr.Kind = ErrInvalidProvider
+	}
+	return err
+}
+
+//Filter returns the keys the filter's account patterns keep
+func (f KeyFilter) Filter(keys []Key) (filtered []Key) {
+	for _, key := range keys {
+		if len(f.Accounts) > 0 && !matchesAccount(f.Accounts, key) {
+			continue
+		}
+		if matchesAccount(f.ExcludeAccounts, key) {
+			continue
+		}
+		filtered = append(filtered, key)
+	}
+	return
+}
+
+//KeysOptions returns the options to collect keys with
+func (f KeyFilter) KeysOptions() KeysOptions {
+	return KeysOptions{IncludeInactiveKeys: f.IncludeInactiveKeys, MaxConcurrency: f.MaxConcurrency}
+}
+
+//matchesAccount reports whether the key's Account or FullAccount matches any
+//of patterns
+func matchesAccount(patterns []string, key Key) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, key.Account); matched {
+			return true
+		}
+		if matched, _ := path.Match(pattern, key.FullAccount); matched {
+			return true
+		}
+	}
+	return false
+}
+
+//configFields maps the fields allowed in a mapping to a pointer to decode
+//each into (a *string, *bool, *int, *[]string, *map[string]string or
+//*time.Duration), or a func to decode it with
+type configFields map[string]interface{}
+
+//decodeProvider decodes and validates a provider
+func decodeProvider(node *yaml.Node) (provider Provider, err error) {
+	options := &provider.Options
+	if err = decodeMapping(node, "provider", configFields{
+		"provider":                 &provider.Provider,
+		"scope":                    &options.Scope,
+		"region":                   &options.Region,
+		"endpoint":                 &options.Endpoint,
+		"credentials":              &options.Credentials,
+		"labels":                   &options.Labels,
+		"includeSystemManagedKeys": &options.IncludeSystemManagedKeys,
+		"awsRole": func(node *yaml.Node) error {
+			return decodeMapping(node, "awsRole", configFields{
+				"accountId":   &provider.AwsRole.AccountID,
+				"roleArn":     &provider.AwsRole.RoleArn,
+				"externalId":  &provider.AwsRole.ExternalID,
+				"sessionName": &provider.AwsRole.SessionName,
+			})
+		},
+		"create": func(node *yaml.Node) error {
+			return decodeMapping(node, "create", configFields{
+				"maxAge":               &options.Create.MaxAge,
+				"extendWhenUsed":       &options.Create.ExtendWhenUsed,
+				"scopes":               &options.Create.Scopes,
+				"uploadPublicKey":      &options.Create.UploadPublicKey,
+				"publicKeyCertificate": &options.Create.PublicKeyCertificate,
+				"keyAlgorithm":         &options.Create.KeyAlgorithm,
+				"privateKeyType":       &options.Create.PrivateKeyType,
+			})
+		},
+	}); err != nil {
+		return
+	}
+	msg := validateConfigProvider(provider)
+	if msg != "" {
+		err = &ConfigError{Line: node.Line, Msg: msg}
+	}
+	return
+}
+
+//validateConfigProvider returns what's wrong with a provider, if anything
+func validateConfigProvider(provider Provider) string {
+	if provider.Provider == "" {
+		return "provider needs to name the provider, e.g. \"gcp\""
+	}
+	if _, err := registeredProvider(provider.Provider); err != nil {
+		return err.Error()
+	}
+	creds := provider.Options.Credentials
+	if creds != "" && !strings.HasPrefix(creds, envCredentialsPrefix) && !strings.HasPrefix(creds, fileCredentialsPrefix) {
+		return fmt.Sprintf("credentials need to be an %sNAME or %sPATH reference, rather than the secret itself",
+			envCredentialsPrefix, fileCredentialsPrefix)
+	}
+	switch provider.Provider {
+	case gcpProviderString:
+		if provider.Options.Scope == "" {
+			return "gcp providers need a scope: a project ID, or organizations/ID or folders/ID"
+		}
+	case awsProviderString:
+		if _, err := resolveAwsRole(provider.AwsRole); err != nil {
+			return err.Error()
+		}
+	case aivenProviderString:
+		if creds == "" {
+			return "aiven providers need credentials, e.g. env:AIVEN_TOKEN"
+		}
+	}
+	return ""
+}
+
+//decodeFilter decodes and validates the key filter
+func decodeFilter(node *yaml.Node, filter *KeyFilter) (err error) {
+	if err = decodeMapping(node, "filter", configFields{
+		"includeInactiveKeys": &filter.IncludeInactiveKeys,
+		"maxConcurrency":      &filter.MaxConcurrency,
+		"accounts":            &filter.Accounts,
+		"excludeAccounts":     &filter.ExcludeAccounts,
+	}); err != nil {
+		return
+	}
+	for _, pattern := range append(append([]string{}, filter.Accounts...), filter.ExcludeAccounts...) {
+		if _, matchErr := path.Match(pattern, ""); matchErr != nil {
+			return &ConfigError{Line: node.Line, Msg: fmt.Sprintf("invalid account pattern %q", pattern)}
+		}
+	}
+	if filter.MaxConcurrency < 0 {
+		err = &ConfigError{Line: node.Line, Msg: "maxConcurrency can't be negative"}
+	}
+	return
+}
+
+//decodePolicyRule decodes and validates a policy rule
+func decodePolicyRule(node *yaml.Node) (rule PolicyRule, err error) {
+	if err = decodeMapping(node, "policy rule", configFields{
+		"provider":          &rule.Provider,
+		"account":           &rule.Account,
+		"exempt":            &rule.Exempt,
+		"maxAge":            &rule.MaxAge,
+		"minLifeRemaining":  &rule.MinLifeRemaining,
+		"dueWithin":         &rule.DueWithin,
+		"maxKeysPerAccount": &rule.MaxKeysPerAccount,
+	}); err != nil {
+		return
+	}
+	if err = (Policy{Rules: []PolicyRule{rule}}).Validate(); err != nil {
+		err = &ConfigError{Line: node.Line, Msg: fmt.Sprintf("invalid account pattern %q", rule.Account)}
+	} else if rule.MaxAge < 0 || rule.MinLifeRemaining < 0 || rule.DueWithin < 0 || rule.MaxKeysPerAccount < 0 {
+		err = &ConfigError{Line: node.Line, Msg: "policy rule limits can't be negative"}
+	}
+	return
+}
+
+//decodeSequence calls decodeItem with each item of a sequence
+func decodeSequence(node *yaml.Node, what string, decodeItem func(item *yaml.Node) error) error {
+	if node.Kind != yaml.SequenceNode {
+		return &ConfigError{Line: node.Line, Msg: fmt.Sprintf("%s needs to be a list", what)}
+	}
+	for _, item := range node.Content {
+		if err := decodeItem(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//decodeMapping decodes each field of a mapping into fields, rejecting any
+//field that isn't in fields
+func decodeMapping(node *yaml.Node, what string, fields configFields) error {
+	if node.Kind != yaml.MappingNode {
+		return &ConfigError{Line: node.Line, Msg: fmt.Sprintf("%s needs to be a mapping", what)}
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		field, ok := fields[key.Value]
+		if !ok {
+			return &ConfigError{Line: key.Line, Msg: fmt.Sprintf("unknown field %q in %s, expected one of: %s",
+				key.Value, what, strings.Join(fields.names(), ", "))}
+		}
+		if err := decodeField(value, key.Value, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//decodeField decodes a field's value into field
+func decodeField(node *yaml.Node, name string, field interface{}) error {
+	switch field := field.(type) {
+	case func(*yaml.Node) error:
+		return field(node)
+	case *time.Duration:
+		var err error
+		if *field, err = parseConfigDuration(node.Value); err != nil || node.Kind != yaml.ScalarNode {
+			return &ConfigError{Line: node.Line,
+				Msg: fmt.Sprintf("%s needs to be a duration, e.g. \"90d\" or \"12h\"", name)}
+		}
+		return nil
+	}
+	if err := node.Decode(field); err != nil {
+		msg := err.Error()
+		if typeErr, ok := err.(*yaml.TypeError); ok {
+			msg = strings.Join(typeErr.Errors, "; ")
+		}
+		configErr := yamlConfigError(node.Line, msg)
+		configErr.Msg = fmt.Sprintf("%s: %s", name, configErr.Msg)
+		return configErr
+	}
+	return nil
+}
+
+//yamlLinePattern matches the line number the YAML package prefixes its
+//error messages with
+var yamlLinePattern = regexp.MustCompile(`^line (\d+): `)
+
+//yamlConfigError returns a ConfigError for a YAML package error message,
+//moving the line number it starts with (if any) to the error's Line
+func yamlConfigError(line int, msg string) *ConfigError {
+	if match := yamlLinePattern.FindStringSubmatch(msg); match != nil {
+		line, _ = strconv.Atoi(match[1])
+		msg = strings.TrimPrefix(msg, match[0])
+	}
+	return &ConfigError{Line: line, Msg: msg}
+}
+
+//parseConfigDuration parses a Go duration (e.g. "12h"), or a number of days
+//(e.g. "90d")
+func parseConfigDuration(value string) (time.Duration, error) {
+	if days := strings.TrimSuffix(value, "d"); days != value {
+		n, err := strconv.ParseFloat(days, 64)
+		return time.Duration(n * float64(24*time.Hour)), err
+	}
+	return time.ParseDuration(value)
+}
+
+//names returns the sorted names of the fields
+func (f configFields) names() (names []string) {
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
@@ -0,0 +1,163 @@
+package keys
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testConfigYAML = `
+providers:
+  - provider: gcp
+    scope: organizations/123
+    credentials: file:/secrets/sa.json
+    includeSystemManagedKeys: true
+  - provider: aws
+    region: eu-west-1
+    awsRole:
+      roleArn: arn:aws:iam::123456789012:role/key-rotation
+    labels:
+      team: platform
+  - provider: aiven
+    credentials: env:AIVEN_TOKEN
+    create:
+      maxAge: 30d
+      extendWhenUsed: true
+      scopes: [projects:read]
+filter:
+  includeInactiveKeys: true
+  maxConcurrency: 4
+  excludeAccounts: [break-glass]
+policy:
+  rules:
+    - account: "ci-*"
+      maxAge: 720h
+      dueWithin: 5d
+      maxKeysPerAccount: 1
+    - provider: aiven
+      minLifeRemaining: 7d
+`
+
+func TestParseConfig(t *testing.T) {
+	config, err := ParseConfig([]byte(testConfigYAML))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := Config{
+		Providers: []Provider{
+			{Provider: "gcp", Options: ProviderOptions{
+				Scope:                    "organizations/123",
+				Credentials:              "file:/secrets/sa.json",
+				IncludeSystemManagedKeys: true,
+			}},
+			{
+				Provider: "aws",
+				AwsRole:  AwsRole{RoleArn: "arn:aws:iam::123456789012:role/key-rotation"},
+				Options:  ProviderOptions{Region: "eu-west-1", Labels: map[string]string{"team": "platform"}},
+			},
+			{Provider: "aiven", Options: ProviderOptions{
+				Credentials: "env:AIVEN_TOKEN",
+				Create:      CreateOptions{MaxAge: 30 * day, ExtendWhenUsed: true, Scopes: []string{"projects:read"}},
+			}},
+		},
+		Filter: KeyFilter{IncludeInactiveKeys: true, MaxConcurrency: 4, ExcludeAccounts: []string{"break-glass"}},
+		Policy: Policy{Rules: []PolicyRule{
+			{Account: "ci-*", MaxAge: 30 * day, DueWithin: 5 * day, MaxKeysPerAccount: 1},
+			{Provider: "aiven", MinLifeRemaining: 7 * day},
+		}},
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("got %+v, want %+v", config, expected)
+	}
+}
+
+func TestParseConfigJSON(t *testing.T) {
+	config, err := ParseConfig([]byte(`{
+	"providers": [{"provider": "gcp", "scope": "project"}],
+	"policy": {"rules": [{"maxAge": "90d"}]}
+}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if config.Providers[0].Options.Scope != "project" || config.Policy.Rules[0].MaxAge != 90*day {
+		t.Errorf("Incorrect config returned, got: %+v", config)
+	}
+}
+
+var parseConfigErrorTests = []struct {
+	config          string
+	line            int
+	invalidProvider bool
+}{
+	{"providers:\n  - provider: gcp\n    scpoe: project\n", 3, true},
+	{"providers:\n  - provider: gpc\n    scope: project\n", 2, true},
+	{"providers:\n  - provider: aiven\n    credentials: abc123secret\n", 2, true},
+	{"providers:\n  - provider: aiven\n", 2, true},
+	{"providers:\n  - provider: gcp\n", 2, true},
+	{"providers:\n  - provider: aws\n    awsRole:\n      roleArn: key-rotation\n", 2, true},
+	{"providers:\n  - provider: aiven\n    credentials: env:T\n    create:\n      maxAge: soon\n", 5, true},
+	{"providers:\n  - provider: aws\nfilter:\n  maxConcurrency: many\n", 4, false},
+	{"providers:\n  - provider: aws\nfilter:\n  accounts: [\"ci-[\"]\n", 4, false},
+	{"providers:\n  - provider: aws\npolicy:\n  rules:\n    - maxAge: 90d\n      dueWithin: -1d\n", 5, false},
+	{"providers:\n  provider: aws\n", 2, true},
+	{"providers: []\n", 1, true},
+	{"providers:\n  - provider: aws\n  - provider: aws\n bad indent\n", 3, false},
+	{"", 0, false},
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	for _, test := range parseConfigErrorTests {
+		_, err := ParseConfig([]byte(test.config))
+		var configErr *ConfigError
+		if !errors.As(err, &configErr) {
+			t.Errorf("%q: got error %v, want a ConfigError", test.config, err)
+			continue
+		}
+		if test.line != 0 && configErr.Line != test.line {
+			t.Errorf("%q: got error on line %d (%s), want line %d", test.config, configErr.Line, err, test.line)
+		}
+		if !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("%q: errors.Is(%v, ErrInvalidConfig) = false, want true", test.config, err)
+		}
+		if errors.Is(err, ErrInvalidProvider) != test.invalidProvider {
+			t.Errorf("%q: errors.Is(%v, ErrInvalidProvider) = %t, want %t",
+				test.config, err, !test.invalidProvider, test.invalidProvider)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(filename, []byte(testConfigYAML), 0600); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	config, err := LoadConfig(filename)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(config.Providers) != 3 {
+		t.Errorf("got %d providers, want 3", len(config.Providers))
+	}
+}
+
+func TestKeyFilter(t *testing.T) {
+	filter := KeyFilter{Accounts: []string{"ci-*", "*@example.com"}, ExcludeAccounts: []string{"ci-legacy"}}
+	keys := []Key{
+		{Account: "ci-deploy"},
+		{Account: "ci-legacy"},
+		{Account: "app"},
+		{Account: "other", FullAccount: "other@example.com"},
+	}
+	var accounts []string
+	for _, key := range filter.Filter(keys) {
+		accounts = append(accounts, key.Account)
+	}
+	if expected := []string{"ci-deploy", "other"}; !reflect.DeepEqual(accounts, expected) {
+		t.Errorf("got accounts %v, want %v", accounts, expected)
+	}
+	if options := filter.KeysOptions(); options != (KeysOptions{}) {
+		t.Errorf("got options %+v, want the defaults", options)
+	}
+}
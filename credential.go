@@ -0,0 +1,112 @@
+package keys
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	awsAccessKeyIDEnvVar     = "AWS_ACCESS_KEY_ID"
+	awsSecretAccessKeyEnvVar = "AWS_SECRET_ACCESS_KEY"
+	gcpCredentialsEnvVar     = "GOOGLE_CREDENTIALS"
+	aivenTokenEnvVar         = "AIVEN_TOKEN"
+	credentialsFileMode      = 0600
+)
+
+//Credential is a new key, decoded from the keyID and newKey returned by
+//CreateKey so that consumers don't each have to know its provider's format
+type Credential struct {
+	//Provider is the name of the provider the key was created with
+	Provider string
+	//KeyID identifies the key: the AWS access key ID, GCP key ID or Aiven
+	//token prefix
+	KeyID string
+	//Secret is the key itself: the AWS secret access key, GCP private key
+	//file (service account JSON or PKCS#12) or full Aiven token
+	Secret string
+	//ServiceAccount is the decoded service account JSON of a GCP key, or nil
+	//if the key isn't one (e.g. it's a PKCS#12 file)
+	ServiceAccount *GcpServiceAccountCredentials
+}
+
+//CreateCredential creates a new key from just provider and account
+//parameters, returning it as a Credential
+func CreateCredential(provider Provider, account string) (Credential, error) {
+	return CreateCredentialWithContext(context.Background(), provider, account)
+}
+
+//CreateCredentialWithContext creates a new key from just provider and account
+//parameters, returning it as a Credential, giving up once ctx is done
+func CreateCredentialWithContext(ctx context.Context, provider Provider, account string) (Credential, error) {
+	keyID, newKey, err := CreateKeyFromScratchWithContext(ctx, provider, account)
+	if err != nil {
+		return Credential{}, err
+	}
+	return NewCredential(provider.Provider, keyID, newKey)
+}
+
+//NewCredential decodes the keyID and newKey returned by a provider's
+//CreateKeyWithContext into a Credential
+func NewCredential(providerName, keyID, newKey string) (credential Credential, err error) {
+	credential = Credential{Provider: providerName, KeyID: keyID, Secret: newKey}
+	if providerName != gcpProviderString || !strings.HasPrefix(strings.TrimSpace(newKey), "{") {
+		return
+	}
+	var serviceAccount GcpServiceAccountCredentials
+	if err = json.Unmarshal([]byte(newKey), &serviceAccount); err != nil {
+		err = fmt.Errorf("Failed decoding GCP service account JSON: %w", err)
+		return
+	}
+	credential.ServiceAccount = &serviceAccount
+	return
+}
+
+//EnvVars returns the environment variables that pass the credential to the
+//provider's own tooling: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY for AWS,
+//GOOGLE_CREDENTIALS (the service account JSON) for GCP and AIVEN_TOKEN for
+//Aiven. It's empty for other providers
+func (c Credential) EnvVars() map[string]string {
+	envVars := map[string]string{}
+	switch c.Provider {
+	case awsProviderString:
+		envVars[awsAccessKeyIDEnvVar] = c.KeyID
+		envVars[awsSecretAccessKeyEnvVar] = c.Secret
+	case gcpProviderString:
+		if c.ServiceAccount != nil {
+			envVars[gcpCredentialsEnvVar] = c.Secret
+		}
+	case aivenProviderString:
+		envVars[aivenTokenEnvVar] = c.Secret
+	}
+	return envVars
+}
+
+//AwsProfile returns the credential as a named profile for an AWS shared
+//credentials file (~/.aws/credentials)
+func (c Credential) AwsProfile(profile string) (string, error) {
+	if c.Provider != awsProviderString {
+		return "", c.unsupported("an AWS credentials file profile")
+	}
+	return fmt.Sprintf("[%s]\naws_access_key_id = %s\naws_secret_access_key = %s\n",
+		profile, c.KeyID, c.Secret), nil
+}
+
+//WriteGoogleApplicationCredentials writes the service account JSON of a GCP
+//key to path, readable only by its owner, for use as
+//GOOGLE_APPLICATION_CREDENTIALS
+func (c Credential) WriteGoogleApplicationCredentials(path string) error {
+	if c.ServiceAccount == nil {
+		return c.unsupported("a GOOGLE_APPLICATION_CREDENTIALS file")
+	}
+	return ioutil.WriteFile(path, []byte(c.Secret), credentialsFileMode)
+}
+
+//unsupported returns the error for rendering the credential as something its
+//provider's keys can't be rendered as
+func (c Credential) unsupported(as string) error {
+	return &KeyError{Kind: ErrNotSupported,
+		Msg: fmt.Sprintf("%s credential can't be rendered as %s", c.Provider, as)}
+}
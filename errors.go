@@ -0,0 +1,207 @@
+package keys
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Sentinel errors classifying common provider failures. Errors returned by
+// the AWS, GCP and Aiven providers wrap these where the failure is recognised,
+// so they can be checked with errors.Is regardless of provider
+var (
+	// ErrKeyLimitReached means an account already holds as many keys as its
+	// provider allows
+	ErrKeyLimitReached = errors.New("key limit reached")
+	// ErrAccountNotFound means the account (user, service account) a key
+	// operation referred to doesn't exist
+	ErrAccountNotFound = errors.New("account not found")
+	// ErrPermissionDenied means the caller's credentials were rejected or lack
+	// the permissions needed
+	ErrPermissionDenied = errors.New("permission denied")
+	// ErrInvalidProvider means a Provider is missing required configuration
+	ErrInvalidProvider = errors.New("invalid provider")
+	// ErrRateLimited means the provider throttled the request
+	ErrRateLimited = errors.New("rate limited")
+	// ErrNotFound means the key, or other resource, a call referred to doesn't
+	// exist
+	ErrNotFound = errors.New("not found")
+	// ErrNotSupported means the provider doesn't support the operation, e.g.
+	// disabling a key
+	ErrNotSupported = errors.New("not supported")
+)
+
+// KeyError classifies a provider failure as one of the sentinel errors above.
+// The underlying SDK or HTTP error, if any, remains available to errors.As
+type KeyError struct {
+	// Kind is the sentinel error this error matches with errors.Is
+	Kind error
+	// Msg describes the failure; Kind's message is used when it's empty
+	Msg string
+	// Err is the underlying error, if any
+	Err error
+}
+
+// Error returns the failure message followed by the underlying error
+func (e *KeyError) Error() string {
+	msg := e.Msg
+	if msg == "" {
+		msg = e.Kind.Error()
+	}
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s", msg, e.Err)
+	}
+	return msg
+}
+
+// Is reports whether target is the sentinel error this error was classified as
+func (e *KeyError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// Unwrap returns the underlying error
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
+
+// UnknownProviderError is returned when a Provider names a provider that
+// hasn't been registered. It matches ErrInvalidProvider with errors.Is
+type UnknownProviderError struct {
+	// Name is the unrecognised provider name
+	Name string
+	// Registered lists the names of the registered providers
+	Registered []string
+}
+
+// Error names the unknown provider and lists the registered ones
+func (e *UnknownProviderError) Error() string {
+	return fmt.Sprintf("unknown provider %q, registered providers are: %s",
+		e.Name, strings.Join(e.Registered, ", "))
+}
+
+// Is reports whether target is ErrInvalidProvider
+func (e *UnknownProviderError) Is(target error) bool {
+	return target == ErrInvalidProvider
+}
+
+// ProviderError records why keys couldn't be collected from a Provider
+type ProviderError struct {
+	Provider Provider
+	Err      error
+}
+
+// Error identifies the provider by name and scope (if any); the provider's
+// credentials are deliberately left out
+func (e *ProviderError) Error() string {
+	name := e.Provider.Provider
+	if scope := e.Provider.Scope(); scope != "" {
+		name = fmt.Sprintf("%s (scope: %s)", name, scope)
+	}
+	return fmt.Sprintf("%s: %s", name, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *ProviderError) Unwrap() error {
+	return e.Err
+}
+
+// ProviderErrors is returned alongside any keys that could be collected when
+// one or more providers fail. It holds one ProviderError per failed provider,
+// in the same order as the providers were requested
+type ProviderErrors []*ProviderError
+
+// Error joins the errors of every failed provider
+func (e ProviderErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, providerErr := range e {
+		msgs[i] = providerErr.Error()
+	}
+	return fmt.Sprintf("%d provider(s) failed: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the error of each failed provider
+func (e ProviderErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, providerErr := range e {
+		errs[i] = providerErr
+	}
+	return errs
+}
+
+// Is reports whether the error of any failed provider matches target. It's
+// implemented explicitly, as errors.Is only follows Unwrap() []error from
+// Go 1.20
+func (e ProviderErrors) Is(target error) bool {
+	for _, providerErr := range e {
+		if errors.Is(providerErr, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first failed provider's error that matches target, and if
+// one is found, sets target to it
+func (e ProviderErrors) As(target interface{}) bool {
+	for _, providerErr := range e {
+		if errors.As(providerErr, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// RotateError records which stage of a key rotation failed. If the new key was
+// created but couldn't be delivered or verified, it's deleted again
+type RotateError struct {
+	// Stage is the stage that failed
+	Stage RotateStage
+	// KeyID is the ID of the new key, if it was created
+	KeyID string
+	// Err is the error the stage failed with
+	Err error
+	// RolledBack is true if deleting the new key was attempted
+	RolledBack bool
+	// RollbackErr is the error deleting the new key failed with, if it did,
+	// in which case the new key still exists
+	RollbackErr error
+}
+
+// Error describes the failed stage, and the rollback if it failed too
+func (e *RotateError) Error() string {
+	msg := fmt.Sprintf("key rotation failed at the %s stage: %s", e.Stage, e.Err)
+	if e.RollbackErr != nil {
+		msg = fmt.Sprintf("%s; deleting new key %s also failed: %s", msg, e.KeyID, e.RollbackErr)
+	}
+	return msg
+}
+
+// Unwrap returns the error the stage failed with
+func (e *RotateError) Unwrap() error {
+	return e.Err
+}
+
+// classifyError wraps err in a KeyError of the given kind. err is returned
+// unchanged if kind is nil
+func classifyError(kind, err error) error {
+	if kind == nil {
+		return err
+	}
+	return &KeyError{Kind: kind, Err: err}
+}
+
+// errorKindFromStatus returns the sentinel error matching an HTTP status code,
+// or nil if there isn't one. notFound is returned for a 404, as what wasn't
+// found depends on the request
+func errorKindFromStatus(status int, notFound error) error {
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrPermissionDenied
+	case http.StatusNotFound:
+		return notFound
+	case http.StatusTooManyRequests:
+		return ErrRateLimited
+	}
+	return nil
+}
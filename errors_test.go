@@ -0,0 +1,60 @@
+package keys
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"google.golang.org/api/googleapi"
+)
+
+var errorClassificationTests = []struct {
+	name string
+	err  error
+	kind error
+}{
+	{"aws no such entity", awsError(awserr.New("NoSuchEntity", "", nil), ErrAccountNotFound), ErrAccountNotFound},
+	{"aws limit exceeded", awsError(awserr.New("LimitExceeded", "", nil), ErrNotFound), ErrKeyLimitReached},
+	{"aws access denied", awsError(awserr.New("AccessDenied", "", nil), ErrNotFound), ErrPermissionDenied},
+	{"aws throttling", awsError(awserr.New("Throttling", "", nil), ErrNotFound), ErrRateLimited},
+	{"gcp forbidden", gcpError(&googleapi.Error{Code: 403}, ErrNotFound), ErrPermissionDenied},
+	{"gcp not found", gcpError(&googleapi.Error{Code: 404}, ErrAccountNotFound), ErrAccountNotFound},
+	{"gcp too many requests", gcpError(&googleapi.Error{Code: 429}, ErrNotFound), ErrRateLimited},
+	{"aiven unauthorized", handleAPIErrors([]Error{{Message: "Invalid token", Status: 401}}), ErrPermissionDenied},
+	{"aiven not found", handleAPIErrors([]Error{{Status: 500}, {Status: 404}}), ErrNotFound},
+	{"gcp project", validateGcpProjectString(""), ErrInvalidProvider},
+}
+
+func TestErrorClassification(t *testing.T) {
+	for _, test := range errorClassificationTests {
+		if !errors.Is(test.err, test.kind) {
+			t.Errorf("%s: errors.Is(%v, %v) = false, want true", test.name, test.err, test.kind)
+		}
+		if wrapped := fmt.Errorf("wrapped: %w", test.err); !errors.Is(wrapped, test.kind) {
+			t.Errorf("%s: errors.Is(%v, %v) = false, want true", test.name, wrapped, test.kind)
+		}
+	}
+}
+
+func TestErrorClassificationKeepsUnderlyingError(t *testing.T) {
+	var awsErr awserr.Error
+	if err := awsError(awserr.New("AccessDenied", "denied", nil), ErrNotFound); !errors.As(err, &awsErr) {
+		t.Errorf("errors.As(%v, awserr.Error) = false, want true", err)
+	}
+	var apiErr *googleapi.Error
+	if err := gcpError(&googleapi.Error{Code: 404}, ErrNotFound); !errors.As(err, &apiErr) {
+		t.Errorf("errors.As(%v, *googleapi.Error) = false, want true", err)
+	}
+}
+
+func TestUnrecognisedErrorsAreUnchanged(t *testing.T) {
+	awsErr := awserr.New("InternalFailure", "", nil)
+	if err := awsError(awsErr, ErrNotFound); err != awsErr {
+		t.Errorf("got %v, want %v", err, awsErr)
+	}
+	gcpErr := &googleapi.Error{Code: 500}
+	if err := gcpError(gcpErr, ErrNotFound); err != gcpErr {
+		t.Errorf("got %v, want %v", err, gcpErr)
+	}
+}
@@ -2,61 +2,242 @@ package keys
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
-	"math"
-	"net/http"
+	"math/big"
+	"net/url"
 	"strings"
+	"sync"
 	"time"
 
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
+	crm "google.golang.org/api/cloudresourcemanager/v3"
+	"google.golang.org/api/googleapi"
 	gcpiam "google.golang.org/api/iam/v1"
+	"google.golang.org/api/option"
 )
 
-//GcpKey type
-type GcpKey struct{}
+//GcpKey type. The zero value builds an IAM service from Application Default
+//Credentials on every call; use NewGcpProvider to supply a service or client
+//options instead
+type GcpKey struct {
+	service                *gcpiam.Service
+	resourceManagerService *crm.Service
+	clientOptions          []option.ClientOption
+	maxConcurrency         int
+}
+
+//GcpOption configures a GcpKey created by NewGcpProvider
+type GcpOption func(*GcpKey)
+
+//NewGcpProvider returns a GcpKey configured by opts, for registering with
+//RegisterProviderWithContext
+func NewGcpProvider(opts ...GcpOption) GcpKey {
+	var g GcpKey
+	for _, opt := range opts {
+		opt(&g)
+	}
+	return g
+}
+
+//WithGcpIAMService makes the provider use service for all IAM calls
+func WithGcpIAMService(service *gcpiam.Service) GcpOption {
+	return func(g *GcpKey) {
+		g.service = service
+	}
+}
+
+//WithGcpResourceManagerService makes the provider use service to discover the
+//projects within an organization or folder
+func WithGcpResourceManagerService(service *crm.Service) GcpOption {
+	return func(g *GcpKey) {
+		g.resourceManagerService = service
+	}
+}
+
+//WithGcpClientOptions sets the options used to build the provider's IAM and
+//Cloud Resource Manager services, e.g. option.WithEndpoint,
+//option.WithCredentialsFile or option.WithHTTPClient
+func WithGcpClientOptions(opts ...option.ClientOption) GcpOption {
+	return func(g *GcpKey) {
+		g.clientOptions = append(g.clientOptions, opts...)
+	}
+}
+
+//WithGcpMaxConcurrency limits how many IAM calls listing keys makes at once:
+//across every project of an organization or folder, or across the service
+//accounts of a single project. Zero or less uses the default of 10. When
+//keys are collected from several providers, KeysOptions.MaxConcurrency
+//limits how many of them are listed at once on top of this
+func WithGcpMaxConcurrency(maxConcurrency int) GcpOption {
+	return func(g *GcpKey) {
+		g.maxConcurrency = maxConcurrency
+	}
+}
+
+const (
+	gcpAccessKeyLimit        = 10
+	gcpDefaultMaxConcurrency = 10
+	gcpOrganizationPrefix    = "organizations/"
+	gcpFolderPrefix          = "folders/"
+	gcpActiveState           = "ACTIVE"
+	gcpUserManagedKeyType    = "USER_MANAGED"
+	gcpUploadedKeyBits       = 2048
+	gcpPKCS12KeyType         = "TYPE_PKCS12_FILE"
+	gcpInvalidGrantError     = "invalid_grant"
+)
+
+//gcpLocalKeyBits are the key algorithms that can be generated locally, and
+//their RSA key sizes
+var gcpLocalKeyBits = map[string]int{
+	"KEY_ALG_RSA_2048": 2048,
+	"KEY_ALG_RSA_4096": 4096,
+}
 
-const gcpAccessKeyLimit = 10
+//gcpUploadedKeyExpiry is when uploaded keys expire if no MaxAge is set; it's
+//the same as the expiry of keys Google generates
+var gcpUploadedKeyExpiry = time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
 
 //Keys returns a slice of keys from any authorised accounts
 func (g GcpKey) Keys(project string, includeInactiveKeys bool, token string) (keys []Key, err error) {
+	return g.KeysWithContext(context.Background(),
+		providerFromArgs(gcpProviderString, project, token), includeInactiveKeys)
+}
+
+//KeysWithContext returns a slice of keys from any authorised accounts in the
+//provider's project (its Options.Scope, or GcpProject). If the scope is an
+//organization or folder ("organizations/ID" or "folders/ID") instead, keys are
+//returned from every active project within it
+func (g GcpKey) KeysWithContext(ctx context.Context, provider Provider, includeInactiveKeys bool) (keys []Key, err error) {
+	project := provider.Scope()
+	if isGcpParent(project) {
+		return g.keysFromParent(ctx, provider, includeInactiveKeys)
+	}
 	if err = validateGcpProjectString(project); err != nil {
 		return
 	}
 	var iamService *gcpiam.Service
-	if iamService, err = gcpIamService(); err != nil {
+	if iamService, err = g.gcpIamService(ctx, provider); err != nil {
 		return
 	}
 	var gcpSAs []*gcpiam.ServiceAccount
-	if gcpSAs, err = gcpServiceAccounts(project, *iamService); err != nil {
+	if gcpSAs, err = gcpServiceAccounts(ctx, project, *iamService); err != nil {
 		return
 	}
-	return keysFromServiceAccount(project, includeInactiveKeys, gcpSAs, iamService)
+	return keysFromServiceAccount(ctx, provider.withScope(project), includeInactiveKeys, gcpSAs, iamService,
+		g.concurrency())
 }
 
-func keysFromServiceAccount(project string, includeInactiveKeys bool, accs []*gcpiam.ServiceAccount, iamService *gcpiam.Service) (keys []Key, err error) {
+//keysFromParent returns the keys in every active project within the
+//provider's organization or folder, each Key's Provider scoped to the project
+//it was found in. A failing project doesn't stop the others: the keys that
+//could be collected are returned, along with a ProviderErrors identifying
+//each project that failed
+func (g GcpKey) keysFromParent(ctx context.Context, provider Provider, includeInactiveKeys bool) (keys []Key, err error) {
+	var crmService *crm.Service
+	if crmService, err = g.gcpResourceManagerService(ctx, provider); err != nil {
+		return
+	}
+	var projects []string
+	if projects, err = gcpProjects(ctx, provider.Scope(), crmService); err != nil {
+		return
+	}
+	// share one IAM service between the projects, rather than building one
+	// for each
+	if g.service, err = g.gcpIamService(ctx, provider); err != nil {
+		return
+	}
+	// projects are listed concurrently, and the service accounts within each
+	// one at a time, so the concurrency limit holds for the whole scope
+	perProject := g
+	perProject.maxConcurrency = 1
+	projectKeys := make([][]Key, len(projects))
+	projectErrs := make([]error, len(projects))
+	runConcurrently(len(projects), g.concurrency(), func(i int) {
+		projectKeys[i], projectErrs[i] = perProject.KeysWithContext(ctx, provider.withScope(projects[i]), includeInactiveKeys)
+	})
+	var failures ProviderErrors
+	for i, keysToAdd := range projectKeys {
+		keys = appendSlice(keys, keysToAdd)
+		if projectErrs[i] != nil {
+			failures = append(failures, &ProviderError{Provider: provider.withScope(projects[i]), Err: projectErrs[i]})
+		}
+	}
+	if len(failures) > 0 {
+		err = failures
+	}
+	return
+}
+
+//keysFromServiceAccount lists the keys of up to limit service accounts at
+//once, returning them in the same order as accs
+func keysFromServiceAccount(ctx context.Context, provider Provider, includeInactiveKeys bool, accs []*gcpiam.ServiceAccount, iamService *gcpiam.Service, limit int) (keys []Key, err error) {
+	var wantedAccs []*gcpiam.ServiceAccount
 	for _, acc := range accs {
 		if includeInactiveKeys || !acc.Disabled {
-			var gcpSAKeys []*gcpiam.ServiceAccountKey
-			if gcpSAKeys, err = gcpServiceAccountKeys(gcpServiceAccountName(project, acc.Email), *iamService); err != nil {
-				return
-			}
-			for _, gcpKey := range gcpSAKeys {
-				var key Key
-				if key, err = keyFromGcpKey(gcpKey, project); err != nil {
-					return
-				}
-				if acc.Disabled {
-					key.Status = "Inactive"
-				}
-				keys = append(keys, key)
-			}
+			wantedAccs = append(wantedAccs, acc)
+		}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	accKeys := make([][]Key, len(wantedAccs))
+	var once sync.Once
+	runConcurrently(len(wantedAccs), limit, func(i int) {
+		var accErr error
+		if accKeys[i], accErr = keysFromOneServiceAccount(ctx, provider, includeInactiveKeys, wantedAccs[i], iamService); accErr != nil {
+			once.Do(func() {
+				err = accErr
+				cancel()
+			})
 		}
+	})
+	for _, keysToAdd := range accKeys {
+		keys = appendSlice(keys, keysToAdd)
 	}
 	return
 }
 
-func keyFromGcpKey(gcpKey *gcpiam.ServiceAccountKey, project string) (key Key, err error) {
+//concurrency returns how many IAM calls listing keys may make at once
+func (g GcpKey) concurrency() int {
+	if g.maxConcurrency <= 0 {
+		return gcpDefaultMaxConcurrency
+	}
+	return g.maxConcurrency
+}
+
+//keysFromOneServiceAccount returns the keys of a single service account,
+//leaving out disabled keys unless includeInactiveKeys is set
+func keysFromOneServiceAccount(ctx context.Context, provider Provider, includeInactiveKeys bool, acc *gcpiam.ServiceAccount, iamService *gcpiam.Service) (keys []Key, err error) {
+	var gcpSAKeys []*gcpiam.ServiceAccountKey
+	if gcpSAKeys, err = gcpServiceAccountKeys(ctx, gcpServiceAccountName(provider.Scope(), acc.Email),
+		!provider.Options.IncludeSystemManagedKeys, *iamService); err != nil {
+		return
+	}
+	for _, gcpKey := range gcpSAKeys {
+		var key Key
+		if key, err = keyFromGcpKey(gcpKey, provider); err != nil {
+			return
+		}
+		if acc.Disabled {
+			key.Status = "Inactive"
+		}
+		if !includeInactiveKeys && gcpKey.Disabled {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return
+}
+
+func keyFromGcpKey(gcpKey *gcpiam.ServiceAccountKey, provider Provider) (key Key, err error) {
 	var timeCreated time.Time
 	if timeCreated, err = time.Parse(gcpTimeFormat, gcpKey.ValidAfterTime); err != nil {
 		return
@@ -80,83 +261,444 @@ func keyFromGcpKey(gcpKey *gcpiam.ServiceAccountKey, project string) (key Key, e
 		return
 	}
 	key = Key{
-		serviceAccountName,
-		fullServiceAccountName,
-		time.Since(timeCreated).Minutes(),
-		keyID,
-		math.Abs(time.Since(expiryTime).Minutes()),
-		strings.Join([]string{serviceAccountName,
+		Account:       serviceAccountName,
+		FullAccount:   fullServiceAccountName,
+		Age:           time.Since(timeCreated).Minutes(),
+		ID:            keyID,
+		LifeRemaining: time.Until(expiryTime).Minutes(),
+		Name: strings.Join([]string{serviceAccountName,
 			keyID[len(keyID)-numIDValuesInName:]}, "_"),
-		Provider{Provider: gcpProviderString, GcpProject: project},
-		"Active",
+		Provider: provider,
+		Status:   status(!gcpKey.Disabled),
+		Metadata: map[string]string{
+			"keyAlgorithm":   gcpKey.KeyAlgorithm,
+			"keyOrigin":      gcpKey.KeyOrigin,
+			"keyType":        gcpKey.KeyType,
+			"privateKeyType": gcpKey.PrivateKeyType,
+		},
 	}
 	return
 }
 
-//CreateKey creates a key in the provided account
+//CreateKey creates a key in the provided account. Unlike
+//CreateKeyWithContext, newKey is base64 encoded, as it always has been
 func (g GcpKey) CreateKey(project, account, token string) (keyID, newKey string, err error) {
+	keyID, newKey, err = g.CreateKeyWithContext(context.Background(),
+		providerFromArgs(gcpProviderString, project, token), account)
+	return keyID, gcpLegacyNewKey(newKey), err
+}
+
+//gcpLegacyNewKey base64 encodes a new key, as returned by the API and by
+//CreateKey before CreateKeyWithContext decoded it
+func gcpLegacyNewKey(newKey string) string {
+	return base64.StdEncoding.EncodeToString([]byte(newKey))
+}
+
+//CreateKeyWithContext creates a key in the provided account
+func (g GcpKey) CreateKeyWithContext(ctx context.Context, provider Provider, account string) (keyID, newKey string, err error) {
+	project := provider.Scope()
 	if err = validateGcpProjectString(project); err != nil {
 		return
 	}
 	var iamService *gcpiam.Service
-	if iamService, err = gcpIamService(); err != nil {
+	if iamService, err = g.gcpIamService(ctx, provider); err != nil {
 		return
 	}
 	var existingKeys []*gcpiam.ServiceAccountKey
-	if existingKeys, err = gcpServiceAccountKeys(gcpServiceAccountName(project, account), *iamService); err != nil {
+	if existingKeys, err = gcpServiceAccountKeys(ctx, gcpServiceAccountName(project, account), true, *iamService); err != nil {
 		return
 	}
 	keyNum := len(existingKeys)
 	if keyNum >= gcpAccessKeyLimit {
-		err = fmt.Errorf("Number of Access Keys for service account: %s is already at its limit (%d)",
-			account, gcpAccessKeyLimit)
+		err = &KeyError{
+			Kind: ErrKeyLimitReached,
+			Msg: fmt.Sprintf("Number of Access Keys for service account: %s is already at its limit (%d)",
+				account, gcpAccessKeyLimit),
+		}
 		return
 	}
+	options := provider.Options.Create
+	if options.UploadPublicKey || options.PublicKeyCertificate != "" {
+		return gcpUploadKey(ctx, project, account, options, iamService)
+	}
 	var key *gcpiam.ServiceAccountKey
 	if key, err = iamService.Projects.ServiceAccounts.Keys.
 		Create(gcpServiceAccountName(project, account),
-			&gcpiam.CreateServiceAccountKeyRequest{}).
+			&gcpiam.CreateServiceAccountKeyRequest{
+				KeyAlgorithm:   options.KeyAlgorithm,
+				PrivateKeyType: options.PrivateKeyType,
+			}).
+		Context(ctx).
 		Do(); err != nil {
+		err = gcpError(err, ErrAccountNotFound)
+		return
+	}
+	// the private key is base64 encoded in the response, whatever its format
+	var privateKeyData []byte
+	if privateKeyData, err = base64.StdEncoding.DecodeString(key.PrivateKeyData); err != nil {
+		return
+	}
+	newKey = string(privateKeyData)
+	keyID = gcpKeyID(key.Name)
+	return
+}
+
+//gcpUploadKey creates a key in the provided account by uploading a public
+//certificate: options' PublicKeyCertificate if it's set, or one for a keypair
+//generated here, in which case newKey is the service account JSON for it
+func gcpUploadKey(ctx context.Context, project, account string, options CreateOptions, iamService *gcpiam.Service) (keyID, newKey string, err error) {
+	cert := []byte(options.PublicKeyCertificate)
+	var privateKey *rsa.PrivateKey
+	if len(cert) == 0 {
+		if options.PrivateKeyType == gcpPKCS12KeyType {
+			err = &KeyError{Kind: ErrNotSupported,
+				Msg: "locally generated keys can only be returned as service account JSON"}
+			return
+		}
+		var bits int
+		if bits, err = gcpKeyBits(options.KeyAlgorithm); err != nil {
+			return
+		}
+		if privateKey, cert, err = gcpKeyPair(account, bits, options.MaxAge); err != nil {
+			return
+		}
+	} else if block, _ := pem.Decode(cert); block == nil || block.Type != "CERTIFICATE" {
+		err = errors.New("PublicKeyCertificate needs to be a PEM-encoded X.509 certificate")
+		return
+	}
+	var key *gcpiam.ServiceAccountKey
+	if key, err = iamService.Projects.ServiceAccounts.Keys.
+		Upload(gcpServiceAccountName(project, account),
+			&gcpiam.UploadServiceAccountKeyRequest{PublicKeyData: base64.StdEncoding.EncodeToString(cert)}).
+		Context(ctx).
+		Do(); err != nil {
+		err = gcpError(err, ErrAccountNotFound)
+		return
+	}
+	keyID = gcpKeyID(key.Name)
+	if privateKey == nil {
+		return
+	}
+	var credentials []byte
+	if credentials, err = gcpCredentialsJSON(project, account, keyID, privateKey); err != nil {
+		return
+	}
+	newKey = string(credentials)
+	return
+}
+
+//gcpKeyBits returns the size of RSA key to generate for a key algorithm, e.g.
+//4096 for "KEY_ALG_RSA_4096", or the default size if algorithm is empty. Only
+//the sizes in gcpLocalKeyBits are generated, so weak keys aren't uploaded and
+//generation can't run for an unbounded time
+func gcpKeyBits(algorithm string) (bits int, err error) {
+	if algorithm == "" {
+		return gcpUploadedKeyBits, nil
+	}
+	bits, ok := gcpLocalKeyBits[algorithm]
+	if !ok {
+		err = &KeyError{Kind: ErrNotSupported,
+			Msg: fmt.Sprintf("unsupported key algorithm for a locally generated key: %s, expected KEY_ALG_RSA_2048 or KEY_ALG_RSA_4096", algorithm)}
+	}
+	return
+}
+
+//gcpKeyPair generates an RSA keypair of the given size, returning the private
+//key and a PEM-encoded self-signed certificate for its public key that's
+//valid for maxAge (or, if it's zero, as long as the keys Google generates)
+func gcpKeyPair(account string, bits int, maxAge time.Duration) (privateKey *rsa.PrivateKey, cert []byte, err error) {
+	if privateKey, err = rsa.GenerateKey(rand.Reader, bits); err != nil {
+		return
+	}
+	var serialNumber *big.Int
+	if serialNumber, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128)); err != nil {
 		return
 	}
-	newKey = key.PrivateKeyData
-	nameSplit := strings.Split(key.Name, "/")
-	keyID = nameSplit[len(nameSplit)-1]
+	notBefore := time.Now().UTC()
+	notAfter := gcpUploadedKeyExpiry
+	if maxAge > 0 {
+		notAfter = notBefore.Add(maxAge)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: account},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	var der []byte
+	if der, err = x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey); err != nil {
+		return
+	}
+	cert = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
 	return
 }
 
+//GcpServiceAccountCredentials is the service account JSON format Google
+//returns the private keys it generates in
+type GcpServiceAccountCredentials struct {
+	Type                    string `json:"type"`
+	ProjectID               string `json:"project_id"`
+	PrivateKeyID            string `json:"private_key_id"`
+	PrivateKey              string `json:"private_key"`
+	ClientEmail             string `json:"client_email"`
+	ClientID                string `json:"client_id,omitempty"`
+	AuthURI                 string `json:"auth_uri"`
+	TokenURI                string `json:"token_uri"`
+	AuthProviderX509CertURL string `json:"auth_provider_x509_cert_url"`
+	ClientX509CertURL       string `json:"client_x509_cert_url"`
+}
+
+//gcpCredentialsJSON returns the service account JSON for a key, assembled
+//from its private key
+func gcpCredentialsJSON(project, account, keyID string, privateKey *rsa.PrivateKey) (credentials []byte, err error) {
+	var der []byte
+	if der, err = x509.MarshalPKCS8PrivateKey(privateKey); err != nil {
+		return
+	}
+	return json.MarshalIndent(GcpServiceAccountCredentials{
+		Type:                    "service_account",
+		ProjectID:               project,
+		PrivateKeyID:            keyID,
+		PrivateKey:              string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		ClientEmail:             account,
+		AuthURI:                 "https://accounts.google.com/o/oauth2/auth",
+		TokenURI:                "https://oauth2.googleapis.com/token",
+		AuthProviderX509CertURL: "https://www.googleapis.com/oauth2/v1/certs",
+		ClientX509CertURL:       "https://www.googleapis.com/robot/v1/metadata/x509/" + url.PathEscape(account),
+	}, "", "  ")
+}
+
+//gcpKeyID returns the ID at the end of a key's resource name
+func gcpKeyID(name string) string {
+	nameSplit := strings.Split(name, "/")
+	return nameSplit[len(nameSplit)-1]
+}
+
 //DeleteKey deletes the specified key from the specified account
 func (g GcpKey) DeleteKey(project, account, keyID, token string) (err error) {
+	return g.DeleteKeyWithContext(context.Background(), Key{
+		FullAccount: account,
+		ID:          keyID,
+		Provider:    providerFromArgs(gcpProviderString, project, token),
+	})
+}
+
+//DeleteKeyWithContext deletes the specified key from its account
+func (g GcpKey) DeleteKeyWithContext(ctx context.Context, key Key) (err error) {
+	project := key.Provider.Scope()
+	if err = validateGcpProjectString(project); err != nil {
+		return
+	}
+	var iamService *gcpiam.Service
+	if iamService, err = g.gcpIamService(ctx, key.Provider); err != nil {
+		return
+	}
+	if _, err = iamService.Projects.ServiceAccounts.Keys.
+		Delete(gcpServiceAccountKeyName(project, key.FullAccount, key.ID)).
+		Context(ctx).
+		Do(); err != nil {
+		err = gcpError(err, ErrNotFound)
+	}
+	return
+}
+
+//DisableKeyWithContext disables the specified key, so it can't be used to
+//authenticate until it's enabled again
+func (g GcpKey) DisableKeyWithContext(ctx context.Context, key Key) (err error) {
+	project := key.Provider.Scope()
+	if err = validateGcpProjectString(project); err != nil {
+		return
+	}
+	var iamService *gcpiam.Service
+	if iamService, err = g.gcpIamService(ctx, key.Provider); err != nil {
+		return
+	}
+	if _, err = iamService.Projects.ServiceAccounts.Keys.
+		Disable(gcpServiceAccountKeyName(project, key.FullAccount, key.ID),
+			&gcpiam.DisableServiceAccountKeyRequest{}).
+		Context(ctx).
+		Do(); err != nil {
+		err = gcpError(err, ErrNotFound)
+	}
+	return
+}
+
+//EnableKeyWithContext enables the specified (disabled) key
+func (g GcpKey) EnableKeyWithContext(ctx context.Context, key Key) (err error) {
+	project := key.Provider.Scope()
 	if err = validateGcpProjectString(project); err != nil {
 		return
 	}
 	var iamService *gcpiam.Service
-	if iamService, err = gcpIamService(); err != nil {
+	if iamService, err = g.gcpIamService(ctx, key.Provider); err != nil {
 		return
 	}
-	_, err = iamService.Projects.ServiceAccounts.Keys.
-		Delete(gcpServiceAccountKeyName(project, account, keyID)).
-		Do()
+	if _, err = iamService.Projects.ServiceAccounts.Keys.
+		Enable(gcpServiceAccountKeyName(project, key.FullAccount, key.ID),
+			&gcpiam.EnableServiceAccountKeyRequest{}).
+		Context(ctx).
+		Do(); err != nil {
+		err = gcpError(err, ErrNotFound)
+	}
 	return
 }
 
-//gcpClient returns a new GCP IAM client
-func gcpIamService() (service *gcpiam.Service, err error) {
-	ctx := context.Background()
-	var client *http.Client
-	if client, err = google.DefaultClient(ctx, gcpiam.CloudPlatformScope); err != nil {
+//VerifyKeyWithContext checks a service account key authenticates, by minting
+//an access token with it
+func (g GcpKey) VerifyKeyWithContext(ctx context.Context, provider Provider, credential Credential) (identity Identity, err error) {
+	if credential.ServiceAccount == nil {
+		err = &KeyError{Kind: ErrNotSupported, Msg: "only keys in service account JSON format can be verified"}
+		return
+	}
+	var creds *google.Credentials
+	if creds, err = google.CredentialsFromJSON(ctx, []byte(credential.Secret), gcpiam.CloudPlatformScope); err != nil {
+		return
+	}
+	// a new key is rejected as an invalid_grant until it's propagated
+	if err = retryWhileDenied(ctx, func() (tokenErr error) {
+		if _, tokenErr = creds.TokenSource.Token(); tokenErr != nil {
+			tokenErr = gcpTokenError(tokenErr)
+		}
+		return
+	}); err != nil {
 		return
 	}
-	return gcpiam.New(client)
+	identity.Account = credential.ServiceAccount.ClientEmail
+	identity.ID = credential.ServiceAccount.ClientEmail
+	return
+}
+
+//gcpTokenError classifies an error minting an access token. A rejected key is
+//an invalid_grant, which is ErrPermissionDenied
+func gcpTokenError(err error) error {
+	var retrieveErr *oauth2.RetrieveError
+	if !errors.As(err, &retrieveErr) {
+		return err
+	}
+	// service account keys mint tokens through the JWT flow, which leaves the
+	// error code in the response body
+	errorCode := retrieveErr.ErrorCode
+	if errorCode == "" {
+		var body struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(retrieveErr.Body, &body) == nil {
+			errorCode = body.Error
+		}
+	}
+	if errorCode == gcpInvalidGrantError {
+		return classifyError(ErrPermissionDenied, err)
+	}
+	return classifyError(errorKindFromStatus(retrieveErr.Response.StatusCode, ErrNotFound), err)
+}
+
+//gcpIamService returns the provider's IAM service, or a new one built from its
+//client options and the Provider's Endpoint and Credentials (falling back to
+//Application Default Credentials)
+func (g GcpKey) gcpIamService(ctx context.Context, provider Provider) (service *gcpiam.Service, err error) {
+	if g.service != nil {
+		return g.service, nil
+	}
+	var opts []option.ClientOption
+	if opts, err = gcpProviderClientOptions(provider); err != nil {
+		return
+	}
+	// the Provider's options come last so they take precedence
+	clientOptions := append([]option.ClientOption{}, g.clientOptions...)
+	return gcpiam.NewService(ctx, append(clientOptions, opts...)...)
+}
+
+//gcpResourceManagerService returns the provider's Cloud Resource Manager
+//service, or a new one built from its client options and the Provider's
+//Credentials. The Provider's Endpoint only applies to IAM, so isn't used
+func (g GcpKey) gcpResourceManagerService(ctx context.Context, provider Provider) (service *crm.Service, err error) {
+	if g.resourceManagerService != nil {
+		return g.resourceManagerService, nil
+	}
+	var opts []option.ClientOption
+	if opts, err = gcpCredentialsClientOptions(provider); err != nil {
+		return
+	}
+	clientOptions := append([]option.ClientOption{}, g.clientOptions...)
+	return crm.NewService(ctx, append(clientOptions, opts...)...)
+}
+
+//gcpProviderClientOptions returns the client options set by a Provider's
+//Options. The deprecated Token is ignored, as it never applied to GCP
+func gcpProviderClientOptions(provider Provider) (opts []option.ClientOption, err error) {
+	if provider.Options.Endpoint != "" {
+		opts = append(opts, option.WithEndpoint(provider.Options.Endpoint))
+	}
+	var credsOpts []option.ClientOption
+	if credsOpts, err = gcpCredentialsClientOptions(provider); err != nil {
+		return
+	}
+	opts = append(opts, credsOpts...)
+	return
+}
+
+//gcpCredentialsClientOptions returns the client options for a Provider's
+//Credentials, if it sets any
+func gcpCredentialsClientOptions(provider Provider) (opts []option.ClientOption, err error) {
+	if provider.Options.Credentials == "" {
+		return
+	}
+	var creds string
+	if creds, err = provider.credentials(); err != nil {
+		return
+	}
+	opts = append(opts, option.WithCredentialsJSON([]byte(creds)))
+	return
+}
+
+//gcpProjects returns the IDs of every active project within parent (an
+//organization or folder), including those in its subfolders
+func gcpProjects(ctx context.Context, parent string, service *crm.Service) (projectIDs []string, err error) {
+	if err = service.Projects.List().
+		Parent(parent).
+		Pages(ctx, func(res *crm.ListProjectsResponse) error {
+			for _, project := range res.Projects {
+				if project.State == gcpActiveState {
+					projectIDs = append(projectIDs, project.ProjectId)
+				}
+			}
+			return nil
+		}); err != nil {
+		err = gcpError(err, ErrNotFound)
+		return
+	}
+	var folders []string
+	if err = service.Folders.List().
+		Parent(parent).
+		Pages(ctx, func(res *crm.ListFoldersResponse) error {
+			for _, folder := range res.Folders {
+				if folder.State == gcpActiveState {
+					folders = append(folders, folder.Name)
+				}
+			}
+			return nil
+		}); err != nil {
+		err = gcpError(err, ErrNotFound)
+		return
+	}
+	for _, folder := range folders {
+		var folderProjectIDs []string
+		if folderProjectIDs, err = gcpProjects(ctx, folder, service); err != nil {
+			return
+		}
+		projectIDs = append(projectIDs, folderProjectIDs...)
+	}
+	return
 }
 
 //gcpServiceAccounts returns a slice of GCP ServiceAccounts
-func gcpServiceAccounts(project string, service gcpiam.Service) (accs []*gcpiam.ServiceAccount, err error) {
+func gcpServiceAccounts(ctx context.Context, project string, service gcpiam.Service) (accs []*gcpiam.ServiceAccount, err error) {
 	var nextPageToken string
 	var accsPage []*gcpiam.ServiceAccount
 
 	for {
-		if accsPage, nextPageToken, err = gcpServiceAccountsPage(project, service, nextPageToken); err != nil {
+		if accsPage, nextPageToken, err = gcpServiceAccountsPage(ctx, project, service, nextPageToken); err != nil {
 			return
 		}
 
@@ -170,12 +712,14 @@ func gcpServiceAccounts(project string, service gcpiam.Service) (accs []*gcpiam.
 	return
 }
 
-func gcpServiceAccountsPage(project string, service gcpiam.Service, pageToken string) (accs []*gcpiam.ServiceAccount, nextPageToken string, err error) {
+func gcpServiceAccountsPage(ctx context.Context, project string, service gcpiam.Service, pageToken string) (accs []*gcpiam.ServiceAccount, nextPageToken string, err error) {
 	var res *gcpiam.ListServiceAccountsResponse
 	if res, err = service.Projects.ServiceAccounts.
 		List(gcpProjectName(project)).
 		PageToken(pageToken).
+		Context(ctx).
 		Do(); err != nil {
+		err = gcpError(err, ErrNotFound)
 		return
 	}
 
@@ -184,13 +728,18 @@ func gcpServiceAccountsPage(project string, service gcpiam.Service, pageToken st
 	return
 }
 
-//gcpServiceAccountKeys returns a slice of ServiceAccountKeys
-func gcpServiceAccountKeys(name string, service gcpiam.Service) (keys []*gcpiam.ServiceAccountKey, err error) {
+//gcpServiceAccountKeys returns a slice of ServiceAccountKeys, limited to
+//user-managed keys if userManagedOnly is set
+func gcpServiceAccountKeys(ctx context.Context, name string, userManagedOnly bool, service gcpiam.Service) (keys []*gcpiam.ServiceAccountKey, err error) {
+	call := service.Projects.ServiceAccounts.Keys.List(name)
+	if userManagedOnly {
+		call = call.KeyTypes(gcpUserManagedKeyType)
+	}
 	var res *gcpiam.ListServiceAccountKeysResponse
-	if res, err = service.Projects.ServiceAccounts.Keys.
-		List(name).
-		KeyTypes("USER_MANAGED").
+	if res, err = call.
+		Context(ctx).
 		Do(); err != nil {
+		err = gcpError(err, ErrAccountNotFound)
 		return
 	}
 	keys = res.Keys
@@ -202,14 +751,16 @@ func gcpProjectName(project string) string {
 	return fmt.Sprintf("projects/%s", project)
 }
 
-//gcpServiceAccountName returns a string of the format:
-//  "projects/{PROJECT}/serviceAccounts/{SA}"
+// gcpServiceAccountName returns a string of the format:
+//
+//	"projects/{PROJECT}/serviceAccounts/{SA}"
 func gcpServiceAccountName(project, sa string) string {
 	return fmt.Sprintf("%s/serviceAccounts/%s", gcpProjectName(project), sa)
 }
 
-//gcpServiceAccountKeyName returns a string of the format:
-//  "projects/{PROJECT}/serviceAccounts/{SA}/keys/{KEY}"
+// gcpServiceAccountKeyName returns a string of the format:
+//
+//	"projects/{PROJECT}/serviceAccounts/{SA}/keys/{KEY}"
 func gcpServiceAccountKeyName(project, sa, key string) string {
 	return fmt.Sprintf("%s/keys/%s", gcpServiceAccountName(project, sa), key)
 }
@@ -217,7 +768,26 @@ func gcpServiceAccountKeyName(project, sa, key string) string {
 //validateGcpProjectString validates the GCP project string
 func validateGcpProjectString(project string) (err error) {
 	if len(project) == 0 {
-		err = errors.New("GCP project string needs to be set")
+		err = &KeyError{Kind: ErrInvalidProvider, Msg: "GCP project string needs to be set"}
+	} else if isGcpParent(project) {
+		err = &KeyError{Kind: ErrInvalidProvider,
+			Msg: fmt.Sprintf("GCP project string needs to be a project, not %s", project)}
 	}
 	return
 }
+
+//isGcpParent reports whether scope is an organization or folder, rather than
+//a project
+func isGcpParent(scope string) bool {
+	return strings.HasPrefix(scope, gcpOrganizationPrefix) || strings.HasPrefix(scope, gcpFolderPrefix)
+}
+
+//gcpError classifies a GCP API error as one of the package's sentinel errors,
+//using notFound for a 404. Unrecognised errors are returned unchanged
+func gcpError(err error, notFound error) error {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+	return classifyError(errorKindFromStatus(apiErr.Code, notFound), err)
+}
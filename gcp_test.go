@@ -1,7 +1,25 @@
 package keys
 
 import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"golang.org/x/oauth2/google"
+	gcpiam "google.golang.org/api/iam/v1"
+	"google.golang.org/api/option"
 )
 
 func TestValidateGcpProjectString(t *testing.T) {
@@ -33,3 +51,466 @@ func TestGcpServiceAccountKeyName(t *testing.T) {
 		t.Errorf("Incorrect string returned, got: %s, want: %s.", actual, expected)
 	}
 }
+
+func TestKeyFromExpiredGcpKey(t *testing.T) {
+	key, err := keyFromGcpKey(&gcpiam.ServiceAccountKey{
+		Name:            "projects/project/serviceAccounts/sa@project.iam.gserviceaccount.com/keys/0123456789abcdef",
+		ValidAfterTime:  time.Now().Add(-240 * time.Hour).UTC().Format(gcpTimeFormat),
+		ValidBeforeTime: time.Now().Add(-48 * time.Hour).UTC().Format(gcpTimeFormat),
+	}, Provider{Provider: gcpProviderString, GcpProject: "project"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if days := key.LifeRemaining / 1440; days > -1.9 || days < -2.1 {
+		t.Errorf("got %.2f days life remaining, want about -2", days)
+	}
+}
+
+func TestGcpProviderUsesClientOptions(t *testing.T) {
+	saEmail := "sa@project.iam.gserviceaccount.com"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/projects/project/serviceAccounts", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"accounts": [{"email": %q}]}`, saEmail)
+	})
+	mux.HandleFunc("/v1/projects/project/serviceAccounts/"+saEmail+"/keys", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"keys": [{
+			"name": "projects/project/serviceAccounts/%s/keys/0123456789abcdef",
+			"validAfterTime": "2020-01-01T00:00:00Z",
+			"validBeforeTime": "9999-12-31T23:59:59Z"
+		}]}`, saEmail)
+	})
+	provider := newFakeGcpProvider(t, mux)
+	keys, err := provider.KeysWithContext(context.Background(),
+		Provider{Provider: gcpProviderString, GcpProject: "project"}, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("got %d keys, want 1", len(keys))
+	}
+	if keys[0].ID != "0123456789abcdef" || keys[0].FullAccount != saEmail || keys[0].Name != "sa_abcdef" {
+		t.Errorf("Incorrect key returned, got: %+v", keys[0])
+	}
+}
+
+func TestGcpKeyStatus(t *testing.T) {
+	saEmail := "sa@project.iam.gserviceaccount.com"
+	keyName := "projects/project/serviceAccounts/" + saEmail + "/keys/"
+	var disabled []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/projects/project/serviceAccounts", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"accounts": [{"email": %q}]}`, saEmail)
+	})
+	mux.HandleFunc("/v1/projects/project/serviceAccounts/"+saEmail+"/keys", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"keys": [
+			{"name": "%s0123456789abcdef", "validAfterTime": "2020-01-01T00:00:00Z", "validBeforeTime": "9999-12-31T23:59:59Z"},
+			{"name": "%sfedcba9876543210", "validAfterTime": "2020-01-01T00:00:00Z", "validBeforeTime": "9999-12-31T23:59:59Z", "disabled": true}
+		]}`, keyName, keyName)
+	})
+	mux.HandleFunc("/v1/"+keyName, func(w http.ResponseWriter, r *http.Request) {
+		disabled = append(disabled, r.Method+" "+r.URL.Path)
+		fmt.Fprint(w, `{}`)
+	})
+	provider := newFakeGcpProvider(t, mux)
+	gcpProvider := Provider{Provider: gcpProviderString, GcpProject: "project"}
+	keys, err := provider.KeysWithContext(context.Background(), gcpProvider, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(keys) != 2 || keys[0].Status != "Active" || keys[1].Status != "Inactive" {
+		t.Fatalf("Incorrect keys returned, got: %+v", keys)
+	}
+	if keys, err = provider.KeysWithContext(context.Background(), gcpProvider, false); err != nil || len(keys) != 1 {
+		t.Fatalf("got %d keys and error %v, want only the active key", len(keys), err)
+	}
+
+	if err = provider.DisableKeyWithContext(context.Background(), keys[0]); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := []string{"POST /v1/" + keyName + "0123456789abcdef:disable"}
+	if !reflect.DeepEqual(disabled, expected) {
+		t.Errorf("got requests %v, want %v", disabled, expected)
+	}
+}
+
+func TestGcpKeysFromOrganization(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3/projects", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("parent") {
+		case "organizations/1":
+			fmt.Fprint(w, `{"projects": [{"projectId": "project-a", "state": "ACTIVE"}]}`)
+		case "folders/2":
+			fmt.Fprint(w, `{"projects": [
+				{"projectId": "project-b", "state": "ACTIVE"},
+				{"projectId": "project-c", "state": "DELETE_REQUESTED"}
+			]}`)
+		default:
+			fmt.Fprint(w, `{}`)
+		}
+	})
+	mux.HandleFunc("/v3/folders", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("parent") == "organizations/1" {
+			fmt.Fprint(w, `{"folders": [{"name": "folders/2", "state": "ACTIVE"}]}`)
+			return
+		}
+		fmt.Fprint(w, `{}`)
+	})
+	for _, project := range []string{"project-a", "project-b"} {
+		saEmail := "sa@" + project + ".iam.gserviceaccount.com"
+		mux.HandleFunc("/v1/projects/"+project+"/serviceAccounts", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `{"accounts": [{"email": %q}]}`, saEmail)
+		})
+		mux.HandleFunc("/v1/projects/"+project+"/serviceAccounts/"+saEmail+"/keys", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `{"keys": [{
+				"name": "projects/%s/serviceAccounts/%s/keys/0123456789abcdef",
+				"validAfterTime": "2020-01-01T00:00:00Z",
+				"validBeforeTime": "9999-12-31T23:59:59Z"
+			}]}`, project, saEmail)
+		})
+	}
+	provider := newFakeGcpProvider(t, mux)
+	keys, err := provider.KeysWithContext(context.Background(),
+		Provider{Provider: gcpProviderString, Options: ProviderOptions{Scope: "organizations/1"}}, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var projects []string
+	for _, key := range keys {
+		projects = append(projects, key.Provider.Scope())
+	}
+	if expected := []string{"project-a", "project-b"}; !reflect.DeepEqual(projects, expected) {
+		t.Errorf("got keys from projects %v, want %v", projects, expected)
+	}
+}
+
+func TestGcpKeysFromOrganizationConcurrency(t *testing.T) {
+	var running, maxSeen int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3/projects", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("parent") != "organizations/1" {
+			fmt.Fprint(w, `{}`)
+			return
+		}
+		var projects []string
+		for i := 0; i < 6; i++ {
+			projects = append(projects, fmt.Sprintf(`{"projectId": "project-%d", "state": "ACTIVE"}`, i))
+		}
+		fmt.Fprintf(w, `{"projects": [%s]}`, strings.Join(projects, ","))
+	})
+	mux.HandleFunc("/v3/folders", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{}`)
+	})
+	mux.HandleFunc("/v1/projects/", func(w http.ResponseWriter, r *http.Request) {
+		if n := atomic.AddInt32(&running, 1); n > atomic.LoadInt32(&maxSeen) {
+			atomic.StoreInt32(&maxSeen, n)
+		}
+		defer atomic.AddInt32(&running, -1)
+		time.Sleep(10 * time.Millisecond)
+		if strings.HasSuffix(r.URL.Path, "/serviceAccounts") {
+			fmt.Fprint(w, `{"accounts": [{"email": "a@x"}, {"email": "b@x"}, {"email": "c@x"}]}`)
+			return
+		}
+		fmt.Fprint(w, `{}`)
+	})
+	provider := newFakeGcpProvider(t, mux, WithGcpMaxConcurrency(3))
+	if _, err := provider.KeysWithContext(context.Background(),
+		Provider{Provider: gcpProviderString, Options: ProviderOptions{Scope: "organizations/1"}}, false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if maxSeen > 3 {
+		t.Errorf("got %d concurrent IAM calls, want at most 3", maxSeen)
+	}
+}
+
+func TestGcpParentScopeRejectedForKeyChanges(t *testing.T) {
+	provider := Provider{Provider: gcpProviderString, Options: ProviderOptions{Scope: "folders/2"}}
+	if _, _, err := (GcpKey{}).CreateKeyWithContext(context.Background(), provider, "sa"); !errors.Is(err, ErrInvalidProvider) {
+		t.Errorf("got error %v, want ErrInvalidProvider", err)
+	}
+}
+
+func TestGcpSystemManagedKeys(t *testing.T) {
+	saEmail := "sa@project.iam.gserviceaccount.com"
+	keyName := "projects/project/serviceAccounts/" + saEmail + "/keys/"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/projects/project/serviceAccounts", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"accounts": [{"email": %q}]}`, saEmail)
+	})
+	mux.HandleFunc("/v1/projects/project/serviceAccounts/"+saEmail+"/keys", func(w http.ResponseWriter, r *http.Request) {
+		keys := []string{fmt.Sprintf(`{"name": "%s0123456789abcdef", "validAfterTime": "2020-01-01T00:00:00Z",
+			"validBeforeTime": "9999-12-31T23:59:59Z", "keyAlgorithm": "KEY_ALG_RSA_2048",
+			"keyOrigin": "USER_PROVIDED", "keyType": "USER_MANAGED", "privateKeyType": "TYPE_UNSPECIFIED"}`, keyName)}
+		if r.URL.Query().Get("keyTypes") == "" {
+			keys = append(keys, fmt.Sprintf(`{"name": "%sfedcba9876543210", "validAfterTime": "2020-01-01T00:00:00Z",
+				"validBeforeTime": "2020-01-15T00:00:00Z", "keyAlgorithm": "KEY_ALG_RSA_2048",
+				"keyOrigin": "GOOGLE_PROVIDED", "keyType": "SYSTEM_MANAGED"}`, keyName))
+		}
+		fmt.Fprintf(w, `{"keys": [%s]}`, strings.Join(keys, ","))
+	})
+	provider := newFakeGcpProvider(t, mux)
+	gcpProvider := Provider{Provider: gcpProviderString, GcpProject: "project"}
+	keys, err := provider.KeysWithContext(context.Background(), gcpProvider, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := map[string]string{
+		"keyAlgorithm":   "KEY_ALG_RSA_2048",
+		"keyOrigin":      "USER_PROVIDED",
+		"keyType":        "USER_MANAGED",
+		"privateKeyType": "TYPE_UNSPECIFIED",
+	}
+	if len(keys) != 1 || !reflect.DeepEqual(keys[0].Metadata, expected) {
+		t.Fatalf("Incorrect keys returned, got: %+v", keys)
+	}
+
+	gcpProvider.Options.IncludeSystemManagedKeys = true
+	if keys, err = provider.KeysWithContext(context.Background(), gcpProvider, false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(keys) != 2 || keys[1].Metadata["keyType"] != "SYSTEM_MANAGED" {
+		t.Errorf("Incorrect keys returned, got: %+v", keys)
+	}
+}
+
+// gcpKeyRequests are the key creation requests a fake IAM API receives
+type gcpKeyRequests struct {
+	created []gcpiam.CreateServiceAccountKeyRequest
+	//uploaded is the public key data of each upload
+	uploaded []string
+}
+
+// Start a fake IAM API that creates keys for saEmail with privateKeyData and
+// accepts uploads of their public keys, recording each request, and return a
+// provider that uses it
+func newFakeGcpKeyServer(t *testing.T, saEmail, privateKeyData string) (GcpKey, *gcpKeyRequests) {
+	requests := &gcpKeyRequests{}
+	keyName := fmt.Sprintf("projects/project/serviceAccounts/%s/keys/0123456789abcdef", saEmail)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/projects/project/serviceAccounts/"+saEmail+"/keys", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			fmt.Fprint(w, `{"keys": []}`)
+			return
+		}
+		var req gcpiam.CreateServiceAccountKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("unexpected error decoding request: %s", err)
+		}
+		requests.created = append(requests.created, req)
+		fmt.Fprintf(w, `{"name": %q, "privateKeyData": %q}`, keyName, privateKeyData)
+	})
+	mux.HandleFunc("/v1/projects/project/serviceAccounts/"+saEmail+"/keys:upload", func(w http.ResponseWriter, r *http.Request) {
+		var req gcpiam.UploadServiceAccountKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("unexpected error decoding request: %s", err)
+		}
+		requests.uploaded = append(requests.uploaded, req.PublicKeyData)
+		fmt.Fprintf(w, `{"name": %q}`, keyName)
+	})
+	return newFakeGcpProvider(t, mux), requests
+}
+
+// Start a fake IAM and Resource Manager API served by handler, and return a
+// provider that uses it
+func newFakeGcpProvider(t *testing.T, handler http.Handler, opts ...GcpOption) GcpKey {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return NewGcpProvider(append([]GcpOption{WithGcpClientOptions(
+		option.WithEndpoint(server.URL+"/"),
+		option.WithoutAuthentication(),
+	)}, opts...)...)
+}
+
+func TestGcpUploadGeneratedKey(t *testing.T) {
+	saEmail := "sa@project.iam.gserviceaccount.com"
+	provider, requests := newFakeGcpKeyServer(t, saEmail, "")
+	gcpProvider := Provider{Provider: gcpProviderString, Options: ProviderOptions{
+		Scope:  "project",
+		Create: CreateOptions{UploadPublicKey: true, MaxAge: 24 * time.Hour},
+	}}
+	keyID, newKey, err := provider.CreateKeyWithContext(context.Background(), gcpProvider, saEmail)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	uploaded := requests.uploaded
+	if keyID != "0123456789abcdef" || len(uploaded) != 1 || len(requests.created) != 0 {
+		t.Fatalf("got key ID %q after %d uploads and %d creates, want %q after 1 upload",
+			keyID, len(uploaded), len(requests.created), "0123456789abcdef")
+	}
+
+	config, err := google.JWTConfigFromJSON([]byte(newKey))
+	if err != nil {
+		t.Fatalf("unexpected error parsing credentials: %s", err)
+	}
+	if config.Email != saEmail || config.PrivateKeyID != keyID {
+		t.Errorf("got credentials for %q (key %q), want %q (key %q)", config.Email, config.PrivateKeyID, saEmail, keyID)
+	}
+
+	certPEM, err := base64.StdEncoding.DecodeString(uploaded[0])
+	if err != nil {
+		t.Fatalf("unexpected error decoding certificate: %s", err)
+	}
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("unexpected error parsing certificate: %s", err)
+	}
+	keyBlock, _ := pem.Decode(config.PrivateKey)
+	privateKey, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		t.Fatalf("unexpected error parsing private key: %s", err)
+	}
+	if !privateKey.(*rsa.PrivateKey).PublicKey.Equal(cert.PublicKey) {
+		t.Error("uploaded certificate doesn't match the returned private key")
+	}
+	if validFor := cert.NotAfter.Sub(cert.NotBefore); validFor != 24*time.Hour {
+		t.Errorf("got certificate valid for %s, want %s", validFor, 24*time.Hour)
+	}
+}
+
+func TestGcpUploadSuppliedCertificate(t *testing.T) {
+	saEmail := "sa@project.iam.gserviceaccount.com"
+	provider, requests := newFakeGcpKeyServer(t, saEmail, "")
+	_, cert, err := gcpKeyPair(saEmail, gcpUploadedKeyBits, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	gcpProvider := Provider{Provider: gcpProviderString, Options: ProviderOptions{
+		Scope:  "project",
+		Create: CreateOptions{PublicKeyCertificate: string(cert)},
+	}}
+	keyID, newKey, err := provider.CreateKeyWithContext(context.Background(), gcpProvider, saEmail)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if keyID != "0123456789abcdef" || newKey != "" {
+		t.Errorf("got key ID %q and new key %q, want %q and no new key", keyID, newKey, "0123456789abcdef")
+	}
+	if expected := []string{base64.StdEncoding.EncodeToString(cert)}; !reflect.DeepEqual(requests.uploaded, expected) {
+		t.Errorf("got uploads %v, want %v", requests.uploaded, expected)
+	}
+
+	gcpProvider.Options.Create.PublicKeyCertificate = "not a certificate"
+	if _, _, err = provider.CreateKeyWithContext(context.Background(), gcpProvider, saEmail); err == nil {
+		t.Error("got no error for an invalid certificate")
+	}
+}
+
+func TestGcpCreateKeyOptions(t *testing.T) {
+	saEmail := "sa@project.iam.gserviceaccount.com"
+	provider, requests := newFakeGcpKeyServer(t, saEmail, base64.StdEncoding.EncodeToString([]byte("PKCS12 bytes")))
+	gcpProvider := Provider{Provider: gcpProviderString, Options: ProviderOptions{
+		Scope:  "project",
+		Create: CreateOptions{KeyAlgorithm: "KEY_ALG_RSA_1024", PrivateKeyType: "TYPE_PKCS12_FILE"},
+	}}
+	_, newKey, err := provider.CreateKeyWithContext(context.Background(), gcpProvider, saEmail)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if newKey != "PKCS12 bytes" {
+		t.Errorf("got new key %q, want %q", newKey, "PKCS12 bytes")
+	}
+	expected := []gcpiam.CreateServiceAccountKeyRequest{{KeyAlgorithm: "KEY_ALG_RSA_1024", PrivateKeyType: "TYPE_PKCS12_FILE"}}
+	if !reflect.DeepEqual(requests.created, expected) || len(requests.uploaded) != 0 {
+		t.Errorf("got requests %+v and %d uploads, want %+v", requests.created, len(requests.uploaded), expected)
+	}
+}
+
+func TestGcpLegacyCreateKeyEncoded(t *testing.T) {
+	saEmail := "sa@project.iam.gserviceaccount.com"
+	privateKeyData := base64.StdEncoding.EncodeToString([]byte(`{"type": "service_account"}`))
+	provider, _ := newFakeGcpKeyServer(t, saEmail, privateKeyData)
+	if _, newKey, err := provider.CreateKey("project", saEmail, ""); err != nil || newKey != privateKeyData {
+		t.Errorf("GcpKey.CreateKey: got new key %q and error %v, want %q", newKey, err, privateKeyData)
+	}
+
+	registered, err := registeredProvider(gcpProviderString)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	RegisterProviderWithContext(gcpProviderString, provider)
+	defer RegisterProviderWithContext(gcpProviderString, registered)
+	key := Key{Provider: Provider{Provider: gcpProviderString, GcpProject: "project"}, FullAccount: saEmail}
+	if _, newKey, err := CreateKey(key); err != nil || newKey != privateKeyData {
+		t.Errorf("CreateKey: got new key %q and error %v, want %q", newKey, err, privateKeyData)
+	}
+	if _, newKey, err := CreateKeyWithContext(context.Background(), key); err != nil || newKey != `{"type": "service_account"}` {
+		t.Errorf("CreateKeyWithContext: got new key %q and error %v, want the decoded key", newKey, err)
+	}
+}
+
+var gcpKeyBitsTests = []struct {
+	in   string
+	bits int
+	err  error
+}{
+	{"", 2048, nil},
+	{"KEY_ALG_RSA_2048", 2048, nil},
+	{"KEY_ALG_RSA_4096", 4096, nil},
+	{"KEY_ALG_UNSPECIFIED", 0, ErrNotSupported},
+	{"KEY_ALG_RSA_1024", 0, ErrNotSupported},
+	{"KEY_ALG_RSA_65536", 0, ErrNotSupported},
+	{"4096", 0, ErrNotSupported},
+}
+
+func TestGcpKeyBits(t *testing.T) {
+	for _, test := range gcpKeyBitsTests {
+		bits, err := gcpKeyBits(test.in)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%q: got error %v, want %v", test.in, err, test.err)
+		} else if err == nil && bits != test.bits {
+			t.Errorf("%q: got %d bits, want %d", test.in, bits, test.bits)
+		}
+	}
+}
+
+func TestGcpVerifyKey(t *testing.T) {
+	defer shortenVerifyRetries()()
+	saEmail := "sa@project.iam.gserviceaccount.com"
+	var assertions []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertions = append(assertions, r.FormValue("assertion"))
+		// the first request is rejected, as for a key that's not yet propagated
+		if r.FormValue("assertion") == "" || len(assertions) == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": "invalid_grant"}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token": "token", "token_type": "Bearer", "expires_in": 3600}`)
+	}))
+	defer server.Close()
+
+	privateKey, _, err := gcpKeyPair(saEmail, gcpUploadedKeyBits, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	credentials, err := gcpCredentialsJSON("project", saEmail, "0123456789abcdef", privateKey)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// send the token request to the fake
+	var serviceAccount map[string]string
+	if err = json.Unmarshal(credentials, &serviceAccount); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	serviceAccount["token_uri"] = server.URL
+	if credentials, err = json.Marshal(serviceAccount); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	credential, err := NewCredential(gcpProviderString, "0123456789abcdef", string(credentials))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	identity, err := GcpKey{}.VerifyKeyWithContext(context.Background(), Provider{Provider: gcpProviderString}, credential)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if identity.Account != saEmail || len(assertions) != 2 || assertions[1] == "" {
+		t.Errorf("got identity %+v after token requests %v", identity, assertions)
+	}
+	if _, err = (GcpKey{}).VerifyKeyWithContext(context.Background(), Provider{Provider: gcpProviderString},
+		Credential{Provider: gcpProviderString, Secret: "PKCS12 bytes"}); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("got error %v, want ErrNotSupported", err)
+	}
+}
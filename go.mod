@@ -7,6 +7,7 @@ require (
 	go.uber.org/zap v1.24.0
 	golang.org/x/oauth2 v0.12.0
 	google.golang.org/api v0.139.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
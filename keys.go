@@ -1,8 +1,15 @@
 package keys
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"go.uber.org/zap"
 )
@@ -14,29 +21,153 @@ type ProviderInterface interface {
 	DeleteKey(project, account, keyID, token string) (err error)
 }
 
+//ProviderInterfaceWithContext is the context-aware successor to
+//ProviderInterface. Implementations receive the whole Provider (or Key) rather
+//than positional strings, and should abandon in-flight calls once ctx is done
+type ProviderInterfaceWithContext interface {
+	KeysWithContext(ctx context.Context, provider Provider, includeInactiveKeys bool) (keys []Key, err error)
+	CreateKeyWithContext(ctx context.Context, provider Provider, account string) (keyID, newKey string, err error)
+	DeleteKeyWithContext(ctx context.Context, key Key) (err error)
+}
+
+//KeyStatusUpdater is implemented by providers that can disable a key without
+//deleting it, and enable it again. It's optional: DisableKey and EnableKey
+//fail with ErrNotSupported for providers that don't implement it
+type KeyStatusUpdater interface {
+	DisableKeyWithContext(ctx context.Context, key Key) (err error)
+	EnableKeyWithContext(ctx context.Context, key Key) (err error)
+}
+
+//KeyVerifier is implemented by providers that can check a new key
+//authenticates, e.g. before the key it replaces is deleted. It's optional:
+//VerifyKey fails with ErrNotSupported for providers that don't implement it
+type KeyVerifier interface {
+	VerifyKeyWithContext(ctx context.Context, provider Provider, credential Credential) (identity Identity, err error)
+}
+
+//Identity is who a verified credential authenticated as
+type Identity struct {
+	//Account is the account the credential belongs to, in the same form as
+	//Key.FullAccount for AWS and GCP, so the two can be compared. An Aiven
+	//key's FullAccount includes its token prefix, which differs between a
+	//key and its replacement, so for Aiven it's the token description instead,
+	//i.e. Key.Account
+	Account string
+	//ID is the provider's own identifier for the caller: the AWS ARN, GCP
+	//service account email, or Aiven token prefix
+	ID string
+}
+
 //Key type
 type Key struct {
-	Account       string
-	FullAccount   string
-	Age           float64
-	ID            string
+	Account     string
+	FullAccount string
+	Age         float64
+	ID          string
+	//LifeRemaining is the minutes until the key expires: 0 if it never
+	//expires, and negative if it already has
 	LifeRemaining float64
 	Name          string
 	Provider      Provider
 	Status        string
+	//LastUsed is when the key was last used; it's zero if the key has never
+	//been used, or the provider doesn't report it
+	LastUsed time.Time
+	//LastUsedService is the service the key was last used with (AWS)
+	LastUsedService string
+	//LastUsedRegion is the region the key was last used in (AWS)
+	LastUsedRegion string
+	//LastUsedIP is the IP address the key was last used from (Aiven)
+	LastUsedIP string
+	//LastUsedUserAgent is the user agent the key was last used by (Aiven)
+	LastUsedUserAgent string
+	//Metadata is provider-specific detail about the key. GCP keys record
+	//their "keyAlgorithm", "keyOrigin" (GOOGLE_PROVIDED or USER_PROVIDED),
+	//"keyType" (USER_MANAGED or SYSTEM_MANAGED) and "privateKeyType"
+	Metadata map[string]string
 }
 
 //Provider type
 type Provider struct {
-	Provider   string
+	Provider string
+	//Deprecated: use Options.Scope
 	GcpProject string
-	Token      string
+	//Deprecated: use Options.Credentials
+	Token string
+	//AwsRole is the role the AWS provider assumes before calling IAM, to
+	//reach an account other than the one the default credentials are for
+	AwsRole AwsRole
+	Options ProviderOptions
+}
+
+//ProviderOptions is provider-scoped configuration, passed in full to
+//ProviderInterfaceWithContext implementations. Each provider uses the fields
+//that apply to it and ignores the rest
+type ProviderOptions struct {
+	//Scope is what keys are looked up within, e.g. the GCP project ID
+	Scope string
+	//Region is the region API calls are made to (AWS)
+	Region string
+	//Endpoint overrides the provider's default API endpoint (AWS, GCP, Aiven)
+	Endpoint string
+	//Credentials are the provider's credentials (the Aiven API token, or GCP
+	//service account JSON), or a reference to them: "env:NAME" reads
+	//environment variable NAME, and "file:PATH" reads the file at PATH
+	Credentials string
+	//Labels are arbitrary metadata, carried through to the Provider of each
+	//Key
+	Labels map[string]string
+	//Create configures the keys created with the provider
+	Create CreateOptions
+	//IncludeSystemManagedKeys lists the keys the provider manages itself,
+	//which can't be rotated, as well as user-managed keys (GCP)
+	IncludeSystemManagedKeys bool
+}
+
+//CreateOptions configures key creation. Each provider uses the fields that
+//apply to it and ignores the rest
+type CreateOptions struct {
+	//MaxAge is how long a new key is valid for before it expires: the
+	//token's max age for Aiven (at least a second, as Aiven counts whole
+	//seconds), and the uploaded certificate's validity for GCP keys created
+	//with UploadPublicKey. Zero means it never expires
+	MaxAge time.Duration
+	//ExtendWhenUsed pushes a new key's expiry back by MaxAge each time it's
+	//used (Aiven)
+	ExtendWhenUsed bool
+	//Scopes limits what a new key can access, e.g. "projects:read" (Aiven)
+	Scopes []string
+	//UploadPublicKey generates a new key's RSA keypair locally and uploads
+	//only its public certificate, so the private key is never held by the
+	//provider. The credential returned is assembled from the local private
+	//key (GCP)
+	UploadPublicKey bool
+	//PublicKeyCertificate is a PEM-encoded X.509 certificate to upload as
+	//the new key, for a private key generated elsewhere (e.g. in an HSM). No
+	//credential is returned, as the private key isn't known (GCP)
+	PublicKeyCertificate string
+	//KeyAlgorithm is the algorithm of a new key, e.g. "KEY_ALG_RSA_2048"
+	//(GCP). Empty uses the provider's default
+	KeyAlgorithm string
+	//PrivateKeyType is the format a new key is returned in:
+	//"TYPE_GOOGLE_CREDENTIALS_FILE" (service account JSON, the default) or
+	//"TYPE_PKCS12_FILE" (GCP)
+	PrivateKeyType string
+}
+
+//KeysOptions configures how keys are collected from multiple providers
+type KeysOptions struct {
+	IncludeInactiveKeys bool
+	//MaxConcurrency limits how many providers are collected from at once. Zero
+	//or less uses the default of 10
+	MaxConcurrency int
 }
 
 const (
 	aivenProviderString     = "aiven"
 	aivenTimeFormat         = "2006-01-02T15:04:05Z"
 	awsProviderString       = "aws"
+	defaultMaxConcurrency   = 10
 	gcpTimeFormat           = "2006-01-02T15:04:05Z"
 	gcpServiceAccountPrefix = "serviceAccounts/"
 	gcpServiceAccountSuffix = "@"
@@ -44,48 +175,402 @@ const (
 	gcpKeySuffix            = ""
 	gcpProviderString       = "gcp"
 	numIDValuesInName       = 6
+	envCredentialsPrefix    = "env:"
+	fileCredentialsPrefix   = "file:"
 )
 
-var providerMap = map[string]ProviderInterface{
+var providerMap = map[string]ProviderInterfaceWithContext{
 	aivenProviderString: AivenKey{},
 	awsProviderString:   AwsKey{},
 	gcpProviderString:   GcpKey{},
 }
 
+var providerMapMutex sync.RWMutex
+
 var logger = stdoutLogger().Sugar()
 
-//RegisterProvider informs the tool about a new cloud provider, in addition to AWS and GCP, and registers it under a unique key
+//RegisterProvider informs the tool about a new cloud provider, in addition to AWS and GCP, and registers it under a unique key.
+//Providers that also implement ProviderInterfaceWithContext are called through
+//their context-aware methods
 func RegisterProvider(providerName string, provider ProviderInterface) {
+	RegisterProviderWithContext(providerName, withContext(provider))
+}
+
+//RegisterProviderWithContext registers a context-aware cloud provider under a
+//unique key
+func RegisterProviderWithContext(providerName string, provider ProviderInterfaceWithContext) {
+	providerMapMutex.Lock()
+	defer providerMapMutex.Unlock()
 	providerMap[providerName] = provider
 }
 
+//RegisteredProviders returns the sorted names of every registered provider,
+//i.e. the values accepted in Provider.Provider
+func RegisteredProviders() (providerNames []string) {
+	providerMapMutex.RLock()
+	defer providerMapMutex.RUnlock()
+	for providerName := range providerMap {
+		providerNames = append(providerNames, providerName)
+	}
+	sort.Strings(providerNames)
+	return
+}
+
+//registeredProvider returns the provider registered under providerName, or an
+//UnknownProviderError if there isn't one
+func registeredProvider(providerName string) (provider ProviderInterfaceWithContext, err error) {
+	providerMapMutex.RLock()
+	provider, ok := providerMap[providerName]
+	providerMapMutex.RUnlock()
+	if !ok {
+		err = &UnknownProviderError{Name: providerName, Registered: RegisteredProviders()}
+	}
+	return
+}
+
 //Keys returns a generic key slice of potentially multiple provider keys
 func Keys(providers []Provider, includeInactiveKeys bool) (keys []Key, err error) {
-	for _, providerRequest := range providers {
-		var providerKeys []Key
-		if providerKeys, err = providerMap[providerRequest.Provider].
-			Keys(providerRequest.GcpProject, includeInactiveKeys, providerRequest.Token); err != nil {
-			return
+	return KeysWithContext(context.Background(), providers, includeInactiveKeys)
+}
+
+//KeysWithContext returns a generic key slice of potentially multiple provider
+//keys, giving up once ctx is done
+func KeysWithContext(ctx context.Context, providers []Provider, includeInactiveKeys bool) (keys []Key, err error) {
+	return KeysWithOptions(ctx, providers, KeysOptions{IncludeInactiveKeys: includeInactiveKeys})
+}
+
+//KeysWithOptions returns a generic key slice of potentially multiple provider
+//keys. Providers are collected from concurrently, and the keys are ordered by
+//the position of their provider in the providers slice, then by account.
+//A failing provider doesn't stop collection from the others: every key that
+//could be collected is returned, along with a ProviderErrors identifying each
+//provider that failed
+func KeysWithOptions(ctx context.Context, providers []Provider, options KeysOptions) (keys []Key, err error) {
+	providerKeys := make([][]Key, len(providers))
+	providerErrs := make([]error, len(providers))
+	runConcurrently(len(providers), options.maxConcurrency(), func(i int) {
+		providerKeys[i], providerErrs[i] = keysFromProvider(ctx, providers[i], options.IncludeInactiveKeys)
+	})
+	var failures ProviderErrors
+	for i, keysToAdd := range providerKeys {
+		keys = appendSlice(keys, keysToAdd)
+		if providerErrs[i] != nil {
+			failures = append(failures, &ProviderError{Provider: providers[i], Err: providerErrs[i]})
 		}
-		keys = appendSlice(keys, providerKeys)
+	}
+	if len(failures) > 0 {
+		err = failures
 	}
 	return
 }
 
+//keysFromProvider returns the keys of a single provider, sorted by account.
+//Any keys the provider returns alongside an error are kept
+func keysFromProvider(ctx context.Context, provider Provider, includeInactiveKeys bool) (keys []Key, err error) {
+	var registered ProviderInterfaceWithContext
+	if registered, err = registeredProvider(provider.Provider); err != nil {
+		return
+	}
+	keys, err = registered.KeysWithContext(ctx, provider, includeInactiveKeys)
+	sortKeys(keys)
+	return
+}
+
 //CreateKeyFromScratch creates a new key from just provider and account
-//parameters (an existing key is not required)
+//parameters (an existing key is not required). New GCP keys are base64
+//encoded, as they always have been
 func CreateKeyFromScratch(provider Provider, account string) (string, string, error) {
-	return providerMap[provider.Provider].CreateKey(provider.GcpProject, account, provider.Token)
+	keyID, newKey, err := CreateKeyFromScratchWithContext(context.Background(), provider, account)
+	if provider.Provider == gcpProviderString {
+		newKey = gcpLegacyNewKey(newKey)
+	}
+	return keyID, newKey, err
 }
 
-//CreateKey creates a new key using details of the provided key
+//CreateKeyFromScratchWithContext creates a new key from just provider and
+//account parameters (an existing key is not required), giving up once ctx is
+//done
+func CreateKeyFromScratchWithContext(ctx context.Context, provider Provider, account string) (string, string, error) {
+	registered, err := registeredProvider(provider.Provider)
+	if err != nil {
+		return "", "", err
+	}
+	return registered.CreateKeyWithContext(ctx, provider, account)
+}
+
+//CreateKey creates a new key using details of the provided key. New GCP
+//keys are base64 encoded, as they always have been
 func CreateKey(key Key) (string, string, error) {
 	return CreateKeyFromScratch(key.Provider, key.FullAccount)
 }
 
+//CreateKeyWithContext creates a new key using details of the provided key,
+//giving up once ctx is done. Unlike CreateKey, new GCP keys are decoded: the
+//service account JSON, or the PKCS#12 file's bytes
+func CreateKeyWithContext(ctx context.Context, key Key) (string, string, error) {
+	return CreateKeyFromScratchWithContext(ctx, key.Provider, key.FullAccount)
+}
+
 //DeleteKey deletes the specified key
 func DeleteKey(key Key) error {
-	return providerMap[key.Provider.Provider].DeleteKey(key.Provider.GcpProject, key.FullAccount, key.ID, key.Provider.Token)
+	return DeleteKeyWithContext(context.Background(), key)
+}
+
+//DeleteKeyWithContext deletes the specified key, giving up once ctx is done
+func DeleteKeyWithContext(ctx context.Context, key Key) error {
+	registered, err := registeredProvider(key.Provider.Provider)
+	if err != nil {
+		return err
+	}
+	return registered.DeleteKeyWithContext(ctx, key)
+}
+
+//DisableKey disables the specified key, so it can't be used until it's
+//enabled again
+func DisableKey(key Key) error {
+	return DisableKeyWithContext(context.Background(), key)
+}
+
+//DisableKeyWithContext disables the specified key, giving up once ctx is done
+func DisableKeyWithContext(ctx context.Context, key Key) error {
+	updater, err := keyStatusUpdater(key.Provider.Provider)
+	if err != nil {
+		return err
+	}
+	return updater.DisableKeyWithContext(ctx, key)
+}
+
+//EnableKey enables the specified (disabled) key
+func EnableKey(key Key) error {
+	return EnableKeyWithContext(context.Background(), key)
+}
+
+//EnableKeyWithContext enables the specified (disabled) key, giving up once ctx
+//is done
+func EnableKeyWithContext(ctx context.Context, key Key) error {
+	updater, err := keyStatusUpdater(key.Provider.Provider)
+	if err != nil {
+		return err
+	}
+	return updater.EnableKeyWithContext(ctx, key)
+}
+
+//VerifyKey checks credential authenticates with provider, returning who it
+//authenticated as
+func VerifyKey(provider Provider, credential Credential) (Identity, error) {
+	return VerifyKeyWithContext(context.Background(), provider, credential)
+}
+
+//VerifyKeyWithContext checks credential authenticates with provider, returning
+//who it authenticated as, giving up once ctx is done
+func VerifyKeyWithContext(ctx context.Context, provider Provider, credential Credential) (Identity, error) {
+	registered, err := unwrappedProvider(provider.Provider)
+	if err != nil {
+		return Identity{}, err
+	}
+	verifier, ok := registered.(KeyVerifier)
+	if !ok {
+		return Identity{}, &KeyError{Kind: ErrNotSupported,
+			Msg: fmt.Sprintf("provider %q doesn't support verifying keys", provider.Provider)}
+	}
+	return verifier.VerifyKeyWithContext(ctx, provider, credential)
+}
+
+//verifyRetryWindow and verifyRetryBackoff bound how long, and how often,
+//verifying a key is retried while it's rejected: new AWS access keys and GCP
+//service account keys can take several seconds to be accepted everywhere
+var (
+	verifyRetryWindow  = 30 * time.Second
+	verifyRetryBackoff = time.Second
+)
+
+//retryWhileDenied calls verify until it succeeds, fails with something other
+//than ErrPermissionDenied, ctx is done or verifyRetryWindow has passed,
+//doubling the wait between attempts. It returns verify's last error
+func retryWhileDenied(ctx context.Context, verify func() error) error {
+	deadline := time.Now().Add(verifyRetryWindow)
+	backoff := verifyRetryBackoff
+	for {
+		err := verify()
+		if err == nil || !errors.Is(err, ErrPermissionDenied) || time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+//unwrappedProvider returns the provider registered under providerName, looking
+//through the legacy shim, so it can be checked for optional interfaces
+func unwrappedProvider(providerName string) (provider interface{}, err error) {
+	if provider, err = registeredProvider(providerName); err != nil {
+		return
+	}
+	if legacy, ok := provider.(legacyProvider); ok {
+		provider = legacy.provider
+	}
+	return
+}
+
+//keyStatusUpdater returns the provider registered under providerName if it
+//implements KeyStatusUpdater, looking through the legacy shim
+func keyStatusUpdater(providerName string) (updater KeyStatusUpdater, err error) {
+	var registered interface{}
+	if registered, err = unwrappedProvider(providerName); err != nil {
+		return
+	}
+	updater, ok := registered.(KeyStatusUpdater)
+	if !ok {
+		err = &KeyError{Kind: ErrNotSupported,
+			Msg: fmt.Sprintf("provider %q doesn't support disabling or enabling keys", providerName)}
+	}
+	return
+}
+
+//withContext adapts a ProviderInterface to ProviderInterfaceWithContext,
+//returning providers that are already context-aware unchanged
+func withContext(provider ProviderInterface) ProviderInterfaceWithContext {
+	if contextProvider, ok := provider.(ProviderInterfaceWithContext); ok {
+		return contextProvider
+	}
+	return legacyProvider{provider}
+}
+
+//legacyProvider is the compatibility shim for providers that only implement
+//ProviderInterface. Their calls can't be interrupted, so ctx is only checked
+//before each call is made
+type legacyProvider struct {
+	provider ProviderInterface
+}
+
+//KeysWithContext calls the wrapped provider's Keys func
+func (l legacyProvider) KeysWithContext(ctx context.Context, provider Provider, includeInactiveKeys bool) (keys []Key, err error) {
+	var token string
+	if token, err = legacyArgs(ctx, provider); err != nil {
+		return
+	}
+	return l.provider.Keys(provider.Scope(), includeInactiveKeys, token)
+}
+
+//CreateKeyWithContext calls the wrapped provider's CreateKey func
+func (l legacyProvider) CreateKeyWithContext(ctx context.Context, provider Provider, account string) (keyID, newKey string, err error) {
+	var token string
+	if token, err = legacyArgs(ctx, provider); err != nil {
+		return
+	}
+	return l.provider.CreateKey(provider.Scope(), account, token)
+}
+
+//DeleteKeyWithContext calls the wrapped provider's DeleteKey func
+func (l legacyProvider) DeleteKeyWithContext(ctx context.Context, key Key) (err error) {
+	var token string
+	if token, err = legacyArgs(ctx, key.Provider); err != nil {
+		return
+	}
+	return l.provider.DeleteKey(key.Provider.Scope(), key.FullAccount, key.ID, token)
+}
+
+//legacyArgs checks ctx isn't done, and resolves the token to pass to a
+//ProviderInterface
+func legacyArgs(ctx context.Context, provider Provider) (token string, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	return provider.credentials()
+}
+
+//providerFromArgs builds a Provider from the positional arguments of
+//ProviderInterface
+func providerFromArgs(providerName, project, token string) Provider {
+	return Provider{Provider: providerName, GcpProject: project, Token: token}
+}
+
+//Scope returns Options.Scope, or the deprecated GcpProject if it's empty
+func (p Provider) Scope() string {
+	if p.Options.Scope != "" {
+		return p.Options.Scope
+	}
+	return p.GcpProject
+}
+
+//withScope returns a copy of p scoped to scope, keeping the deprecated
+//GcpProject in step for callers that still read it
+func (p Provider) withScope(scope string) Provider {
+	p.Options.Scope = scope
+	p.GcpProject = scope
+	return p
+}
+
+//credentials resolves Options.Credentials, reading it from the environment or
+//a file if it's a reference. If it's empty, the deprecated Token is returned
+//as it is: it was never a reference, so a raw token starting with "env:" or
+//"file:" still works
+func (p Provider) credentials() (creds string, err error) {
+	creds = p.Options.Credentials
+	if creds == "" {
+		return p.Token, nil
+	}
+	if name := strings.TrimPrefix(creds, envCredentialsPrefix); name != creds {
+		var ok bool
+		if creds, ok = os.LookupEnv(name); !ok {
+			err = &KeyError{Kind: ErrInvalidProvider,
+				Msg: fmt.Sprintf("credentials environment variable %s is not set", name)}
+		}
+	} else if path := strings.TrimPrefix(creds, fileCredentialsPrefix); path != creds {
+		var contents []byte
+		if contents, err = ioutil.ReadFile(path); err != nil {
+			err = &KeyError{Kind: ErrInvalidProvider, Msg: "failed to read credentials file", Err: err}
+		}
+		creds = strings.TrimSpace(string(contents))
+	}
+	return
+}
+
+//maxConcurrency returns the configured concurrency limit, or the default
+func (o KeysOptions) maxConcurrency() int {
+	if o.MaxConcurrency <= 0 {
+		return defaultMaxConcurrency
+	}
+	return o.MaxConcurrency
+}
+
+//runConcurrently calls fn with each index in [0, n), using at most limit
+//goroutines, and returns once every call has returned
+func runConcurrently(n, limit int, fn func(i int)) {
+	if limit > n {
+		limit = n
+	}
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < limit; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+}
+
+//sortKeys sorts keys by account, then key ID, so results don't depend on the
+//order a provider's API happened to return them in
+func sortKeys(keys []Key) {
+	sort.SliceStable(keys, func(i, j int) bool {
+		if keys[i].Account != keys[j].Account {
+			return keys[i].Account < keys[j].Account
+		}
+		return keys[i].ID < keys[j].ID
+	})
 }
 
 //appendSlice appends the 2nd slice to the 1st, and returns the resulting slice
@@ -1,9 +1,14 @@
 package keys
 
 import (
+	"context"
 	"errors"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var substringTests = []struct {
@@ -34,11 +39,11 @@ func TestSubstring(t *testing.T) {
 func TestAppendSlice(t *testing.T) {
 	sliceOne := make([]Key, 0)
 	accountOne := "account-one"
-	keyOne := Key{accountOne, "", 0, "", 1, "", Provider{"", "", ""}, "Active"}
+	keyOne := Key{Account: accountOne, LifeRemaining: 1, Status: "Active"}
 	sliceOne = append(sliceOne, keyOne)
 	sliceTwo := make([]Key, 0)
 	accountTwo := "account-two"
-	keyTwo := Key{accountTwo, "", 2, "", 3, "", Provider{"", "", ""}, "Active"}
+	keyTwo := Key{Account: accountTwo, Age: 2, LifeRemaining: 3, Status: "Active"}
 	sliceTwo = append(sliceTwo, keyTwo)
 	appendedSlice := appendSlice(sliceOne, sliceTwo)
 
@@ -51,3 +56,358 @@ func TestAppendSlice(t *testing.T) {
 			appendedSlice[1], keyTwo)
 	}
 }
+
+type legacyTestProvider struct {
+	keys []Key
+}
+
+func (l legacyTestProvider) Keys(project string, includeInactiveKeys bool, token string) ([]Key, error) {
+	return l.keys, nil
+}
+
+func (l legacyTestProvider) CreateKey(project, account, token string) (string, string, error) {
+	return "id", "key", nil
+}
+
+func (l legacyTestProvider) DeleteKey(project, account, keyID, token string) error {
+	return nil
+}
+
+func TestRegisterProviderLegacyShim(t *testing.T) {
+	key := Key{Account: "account", Provider: Provider{Provider: "legacy"}}
+	RegisterProvider("legacy", legacyTestProvider{[]Key{key}})
+	defer delete(providerMap, "legacy")
+
+	keys, err := Keys([]Provider{{Provider: "legacy"}}, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(keys) != 1 || !reflect.DeepEqual(keys[0], key) {
+		t.Errorf("Incorrect keys returned, got: %+v, want: %+v.", keys, []Key{key})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = KeysWithContext(ctx, []Provider{{Provider: "legacy"}}, true); !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestWithContextKeepsContextProviders(t *testing.T) {
+	if _, ok := withContext(AwsKey{}).(AwsKey); !ok {
+		t.Error("context-aware provider was wrapped in the legacy shim")
+	}
+	if _, ok := withContext(legacyTestProvider{}).(legacyProvider); !ok {
+		t.Error("legacy provider was not wrapped in the legacy shim")
+	}
+}
+
+type contextTestProvider struct {
+	keys    map[string][]Key
+	errs    map[string]error
+	running *int32
+	maxSeen *int32
+}
+
+func (c contextTestProvider) KeysWithContext(ctx context.Context, provider Provider, includeInactiveKeys bool) ([]Key, error) {
+	if c.running != nil {
+		running := atomic.AddInt32(c.running, 1)
+		defer atomic.AddInt32(c.running, -1)
+		for {
+			maxSeen := atomic.LoadInt32(c.maxSeen)
+			if running <= maxSeen || atomic.CompareAndSwapInt32(c.maxSeen, maxSeen, running) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return append([]Key(nil), c.keys[provider.GcpProject]...), c.errs[provider.GcpProject]
+}
+
+func (c contextTestProvider) CreateKeyWithContext(ctx context.Context, provider Provider, account string) (string, string, error) {
+	return "", "", nil
+}
+
+func (c contextTestProvider) DeleteKeyWithContext(ctx context.Context, key Key) error {
+	return nil
+}
+
+func TestKeysWithOptionsOrdering(t *testing.T) {
+	RegisterProviderWithContext("ordered", contextTestProvider{keys: map[string][]Key{
+		"one": {{Account: "b", ID: "2"}, {Account: "a", ID: "1"}},
+		"two": {{Account: "d", ID: "4"}, {Account: "c", ID: "5"}, {Account: "c", ID: "3"}},
+	}})
+	defer delete(providerMap, "ordered")
+
+	keys, err := KeysWithOptions(context.Background(), []Provider{
+		{Provider: "ordered", GcpProject: "two"},
+		{Provider: "ordered", GcpProject: "one"},
+	}, KeysOptions{MaxConcurrency: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var ids []string
+	for _, key := range keys {
+		ids = append(ids, key.ID)
+	}
+	expected := []string{"3", "5", "4", "1", "2"}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Errorf("Incorrect key order, got: %v, want: %v.", ids, expected)
+	}
+}
+
+func TestKeysWithOptionsConcurrencyLimit(t *testing.T) {
+	var running, maxSeen int32
+	RegisterProviderWithContext("limited", contextTestProvider{running: &running, maxSeen: &maxSeen})
+	defer delete(providerMap, "limited")
+
+	providers := make([]Provider, 10)
+	for i := range providers {
+		providers[i] = Provider{Provider: "limited"}
+	}
+	if _, err := KeysWithOptions(context.Background(), providers, KeysOptions{MaxConcurrency: 3}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if maxSeen > 3 {
+		t.Errorf("got %d concurrent providers, want at most 3", maxSeen)
+	}
+}
+
+func TestKeysWithOptionsPartialResults(t *testing.T) {
+	providerErr := errors.New("permission denied")
+	goodKey := Key{Account: "good", ID: "1"}
+	RegisterProviderWithContext("failing", contextTestProvider{
+		keys: map[string][]Key{"good": {goodKey}},
+		errs: map[string]error{"bad": providerErr, "worse": providerErr},
+	})
+	defer delete(providerMap, "failing")
+
+	keys, err := KeysWithOptions(context.Background(), []Provider{
+		{Provider: "failing", GcpProject: "worse"},
+		{Provider: "failing", GcpProject: "good"},
+		{Provider: "failing", GcpProject: "bad"},
+	}, KeysOptions{})
+	if len(keys) != 1 || !reflect.DeepEqual(keys[0], goodKey) {
+		t.Errorf("Incorrect keys returned, got: %+v, want: %+v.", keys, []Key{goodKey})
+	}
+	var providerErrs ProviderErrors
+	if !errors.As(err, &providerErrs) {
+		t.Fatalf("got error %v, want ProviderErrors", err)
+	}
+	if len(providerErrs) != 2 ||
+		providerErrs[0].Provider.GcpProject != "worse" ||
+		providerErrs[1].Provider.GcpProject != "bad" {
+		t.Errorf("Incorrect provider errors, got: %v", providerErrs)
+	}
+	if !errors.Is(err, providerErr) {
+		t.Errorf("errors.Is(%v, %v) = false, want true", err, providerErr)
+	}
+}
+
+func TestProviderErrorsIsAs(t *testing.T) {
+	keyErr := &KeyError{Kind: ErrPermissionDenied, Msg: "expired credentials"}
+	err := ProviderErrors{
+		{Provider: Provider{Provider: "aws"}, Err: errors.New("timeout")},
+		{Provider: Provider{Provider: "gcp"}, Err: keyErr},
+	}
+	// the methods are called directly, as errors.Is and errors.As only follow
+	// Unwrap() []error from Go 1.20
+	if !err.Is(ErrPermissionDenied) || err.Is(ErrNotFound) {
+		t.Errorf("got Is(ErrPermissionDenied) = %t and Is(ErrNotFound) = %t, want true and false",
+			err.Is(ErrPermissionDenied), err.Is(ErrNotFound))
+	}
+	var target *KeyError
+	if !err.As(&target) || target != keyErr {
+		t.Errorf("got As target %v, want %v", target, keyErr)
+	}
+}
+
+func TestUnknownProvider(t *testing.T) {
+	provider := Provider{Provider: "gpc"}
+	_, err := Keys([]Provider{provider}, true)
+	var unknownErr *UnknownProviderError
+	if !errors.As(err, &unknownErr) {
+		t.Fatalf("got error %v, want UnknownProviderError", err)
+	}
+	if unknownErr.Name != "gpc" || !reflect.DeepEqual(unknownErr.Registered, RegisteredProviders()) {
+		t.Errorf("Incorrect error returned, got: %+v", unknownErr)
+	}
+	if !errors.Is(err, ErrInvalidProvider) {
+		t.Errorf("errors.Is(%v, ErrInvalidProvider) = false, want true", err)
+	}
+	if _, _, err = CreateKeyFromScratch(provider, "account"); !errors.Is(err, ErrInvalidProvider) {
+		t.Errorf("CreateKeyFromScratch: got error %v, want ErrInvalidProvider", err)
+	}
+	if err = DeleteKey(Key{Provider: provider}); !errors.Is(err, ErrInvalidProvider) {
+		t.Errorf("DeleteKey: got error %v, want ErrInvalidProvider", err)
+	}
+}
+
+func TestRegisteredProviders(t *testing.T) {
+	expected := []string{"aiven", "aws", "gcp"}
+	if actual := RegisteredProviders(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Incorrect providers returned, got: %v, want: %v.", actual, expected)
+	}
+}
+
+func TestProviderScope(t *testing.T) {
+	if scope := (Provider{GcpProject: "project"}).Scope(); scope != "project" {
+		t.Errorf("got %q, want %q", scope, "project")
+	}
+	provider := Provider{GcpProject: "project", Options: ProviderOptions{Scope: "scope"}}
+	if scope := provider.Scope(); scope != "scope" {
+		t.Errorf("got %q, want %q", scope, "scope")
+	}
+}
+
+func TestProviderCredentials(t *testing.T) {
+	t.Setenv("CLOUD_KEY_CLIENT_TEST_TOKEN", "env-token")
+	credsFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(credsFile, []byte("file-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var credentialsTests = []struct {
+		provider Provider
+		out      string
+		err      error
+	}{
+		{Provider{Token: "token"}, "token", nil},
+		{Provider{Token: "env:CLOUD_KEY_CLIENT_TEST_TOKEN"}, "env:CLOUD_KEY_CLIENT_TEST_TOKEN", nil},
+		{Provider{Token: "token", Options: ProviderOptions{Credentials: "creds"}}, "creds", nil},
+		{Provider{Options: ProviderOptions{Credentials: "env:CLOUD_KEY_CLIENT_TEST_TOKEN"}}, "env-token", nil},
+		{Provider{Options: ProviderOptions{Credentials: "file:" + credsFile}}, "file-token", nil},
+		{Provider{Options: ProviderOptions{Credentials: "env:CLOUD_KEY_CLIENT_TEST_UNSET"}}, "", ErrInvalidProvider},
+		{Provider{Options: ProviderOptions{Credentials: "file:" + credsFile + ".missing"}}, "", ErrInvalidProvider},
+	}
+	for _, test := range credentialsTests {
+		creds, err := test.provider.credentials()
+		if !errors.Is(err, test.err) {
+			t.Errorf("%+v: got error %v, want %v", test.provider, err, test.err)
+		} else if creds != test.out {
+			t.Errorf("got %q, want %q", creds, test.out)
+		}
+	}
+}
+
+type recordingLegacyProvider struct {
+	legacyTestProvider
+	project, token *string
+}
+
+func (r recordingLegacyProvider) Keys(project string, includeInactiveKeys bool, token string) ([]Key, error) {
+	*r.project, *r.token = project, token
+	return nil, nil
+}
+
+func TestLegacyProviderReceivesOptions(t *testing.T) {
+	var project, token string
+	RegisterProvider("recording", recordingLegacyProvider{project: &project, token: &token})
+	defer delete(providerMap, "recording")
+
+	t.Setenv("CLOUD_KEY_CLIENT_TEST_TOKEN", "env-token")
+	_, err := Keys([]Provider{{Provider: "recording", Options: ProviderOptions{
+		Scope:       "scope",
+		Credentials: "env:CLOUD_KEY_CLIENT_TEST_TOKEN",
+	}}}, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if project != "scope" || token != "env-token" {
+		t.Errorf("got project %q and token %q, want %q and %q", project, token, "scope", "env-token")
+	}
+}
+
+type statusLegacyTestProvider struct {
+	legacyTestProvider
+	disabled *string
+}
+
+func (s statusLegacyTestProvider) DisableKeyWithContext(ctx context.Context, key Key) error {
+	*s.disabled = key.ID
+	return nil
+}
+
+func (s statusLegacyTestProvider) EnableKeyWithContext(ctx context.Context, key Key) error {
+	return nil
+}
+
+func TestDisableKey(t *testing.T) {
+	var disabled string
+	RegisterProvider("disabling", statusLegacyTestProvider{disabled: &disabled})
+	defer delete(providerMap, "disabling")
+	RegisterProviderWithContext("ordered", contextTestProvider{})
+	defer delete(providerMap, "ordered")
+
+	if err := DisableKey(Key{ID: "key", Provider: Provider{Provider: "disabling"}}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if disabled != "key" {
+		t.Errorf("got disabled key %q, want %q", disabled, "key")
+	}
+	if err := EnableKey(Key{Provider: Provider{Provider: "ordered"}}); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("got error %v, want ErrNotSupported", err)
+	}
+	if err := DisableKey(Key{Provider: Provider{Provider: "gpc"}}); !errors.Is(err, ErrInvalidProvider) {
+		t.Errorf("got error %v, want ErrInvalidProvider", err)
+	}
+}
+
+func TestVerifyKeyNotSupported(t *testing.T) {
+	RegisterProvider("legacy", legacyTestProvider{})
+	defer delete(providerMap, "legacy")
+	if _, err := VerifyKey(Provider{Provider: "legacy"}, Credential{}); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("got error %v, want ErrNotSupported", err)
+	}
+}
+
+// shortenVerifyRetries makes verification retries quick for the duration of
+// a test, returning a func that restores them
+func shortenVerifyRetries() func() {
+	window, backoff := verifyRetryWindow, verifyRetryBackoff
+	verifyRetryWindow, verifyRetryBackoff = 100*time.Millisecond, time.Millisecond
+	return func() {
+		verifyRetryWindow, verifyRetryBackoff = window, backoff
+	}
+}
+
+var retryWhileDeniedTests = []struct {
+	name  string
+	errs  []error
+	calls int
+	err   error
+}{
+	{"accepted", []error{nil}, 1, nil},
+	{"accepted once propagated", []error{ErrPermissionDenied, ErrPermissionDenied, nil}, 3, nil},
+	{"other errors aren't retried", []error{ErrNotFound}, 1, ErrNotFound},
+}
+
+func TestRetryWhileDenied(t *testing.T) {
+	defer shortenVerifyRetries()()
+	for _, test := range retryWhileDeniedTests {
+		calls := 0
+		err := retryWhileDenied(context.Background(), func() error {
+			calls++
+			return test.errs[calls-1]
+		})
+		if err != test.err || calls != test.calls {
+			t.Errorf("%s: got error %v after %d calls, want %v after %d", test.name, err, calls, test.err, test.calls)
+		}
+	}
+
+	start := time.Now()
+	err := retryWhileDenied(context.Background(), func() error { return ErrPermissionDenied })
+	if err != ErrPermissionDenied || time.Since(start) > time.Second {
+		t.Errorf("got error %v after %s, want ErrPermissionDenied once the retry window passed", err, time.Since(start))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err = retryWhileDenied(ctx, func() error {
+		calls++
+		cancel()
+		return ErrPermissionDenied
+	})
+	if err != ErrPermissionDenied || calls != 1 {
+		t.Errorf("got error %v after %d calls, want ErrPermissionDenied after 1 once ctx is done", err, calls)
+	}
+}
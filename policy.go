@@ -0,0 +1,209 @@
+package keys
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//PolicyStatus is how a key stands against a Policy
+type PolicyStatus string
+
+//The statuses a key can be classified as, from best to worst (exempt keys
+//aren't judged)
+const (
+	PolicyExempt    PolicyStatus = "exempt"
+	PolicyCompliant PolicyStatus = "compliant"
+	PolicyDue       PolicyStatus = "due-for-rotation"
+	PolicyOverdue   PolicyStatus = "overdue"
+)
+
+//Policy classifies keys by the first of its Rules that matches each of them.
+//Keys no rule matches are exempt
+type Policy struct {
+	Rules []PolicyRule
+}
+
+//PolicyRule is the rotation policy for the keys of matching providers and
+//accounts. Zero limits aren't applied
+type PolicyRule struct {
+	//Provider matches Key.Provider.Provider; empty matches every provider
+	Provider string
+	//Account is a path.Match pattern (e.g. "ci-*") matched against
+	//Key.Account and Key.FullAccount; empty matches every account
+	Account string
+	//Exempt allow-lists the matching keys, so they're never flagged
+	Exempt bool
+	//MaxAge is the age keys are overdue for rotation at
+	MaxAge time.Duration
+	//MinLifeRemaining is the life remaining that expiring keys are overdue
+	//for rotation below. Keys that don't expire (a LifeRemaining of 0) are
+	//never flagged by it, and keys that have expired (a negative
+	//LifeRemaining) are always overdue, even if it isn't set
+	MinLifeRemaining time.Duration
+	//DueWithin is how long before breaching MaxAge or MinLifeRemaining keys
+	//are due for rotation
+	DueWithin time.Duration
+	//MaxKeysPerAccount is how many keys an account should have; its oldest
+	//keys over the limit are due for rotation
+	MaxKeysPerAccount int
+}
+
+//KeyEvaluation is a key's classification against a Policy
+type KeyEvaluation struct {
+	Key    Key
+	Status PolicyStatus
+	//Reasons explains the status, one reason per limit the key breached (or
+	//why it's exempt)
+	Reasons []string
+	//Rule is the index of the rule that matched the key, or -1 if none did
+	Rule int
+}
+
+//Validate checks the policy's account patterns are well-formed
+func (p Policy) Validate() error {
+	for i, rule := range p.Rules {
+		if _, err := path.Match(rule.Account, ""); err != nil {
+			return fmt.Errorf("Invalid account pattern %q in policy rule %d: %w", rule.Account, i, err)
+		}
+	}
+	return nil
+}
+
+//Evaluate classifies each key against the policy, returning the evaluations
+//in the same order as keys. All of an account's keys need evaluating
+//together for MaxKeysPerAccount to be applied
+func (p Policy) Evaluate(keys []Key) []KeyEvaluation {
+	evaluations := make([]KeyEvaluation, len(keys))
+	accountKeys := map[string][]int{}
+	for i, key := range keys {
+		evaluations[i] = KeyEvaluation{Key: key, Status: PolicyCompliant, Rule: p.matchingRule(key)}
+		accountKeys[policyAccount(key)] = append(accountKeys[policyAccount(key)], i)
+	}
+	for i := range evaluations {
+		evaluation := &evaluations[i]
+		if evaluation.Rule < 0 {
+			evaluation.Status = PolicyExempt
+			evaluation.Reasons = []string{"no policy rule matches the key"}
+			continue
+		}
+		rule := p.Rules[evaluation.Rule]
+		if rule.Exempt {
+			evaluation.Status = PolicyExempt
+			evaluation.Reasons = []string{fmt.Sprintf("the account is exempt (rule %d)", evaluation.Rule)}
+			continue
+		}
+		rule.evaluateAge(evaluation)
+		rule.evaluateLifeRemaining(evaluation)
+		rule.evaluateKeyCount(evaluation, i, keys, accountKeys[policyAccount(evaluation.Key)])
+	}
+	return evaluations
+}
+
+//matchingRule returns the index of the first rule matching key, or -1
+func (p Policy) matchingRule(key Key) int {
+	for i, rule := range p.Rules {
+		if rule.matches(key) {
+			return i
+		}
+	}
+	return -1
+}
+
+//matches reports whether the rule applies to key. Malformed patterns match
+//nothing; Validate reports them
+func (r PolicyRule) matches(key Key) bool {
+	if r.Provider != "" && r.Provider != key.Provider.Provider {
+		return false
+	}
+	if r.Account == "" {
+		return true
+	}
+	matched, _ := path.Match(r.Account, key.Account)
+	fullMatched, _ := path.Match(r.Account, key.FullAccount)
+	return matched || fullMatched
+}
+
+//evaluateAge flags keys nearing or past MaxAge
+func (r PolicyRule) evaluateAge(evaluation *KeyEvaluation) {
+	if r.MaxAge <= 0 {
+		return
+	}
+	age := minutes(evaluation.Key.Age)
+	if age >= r.MaxAge {
+		evaluation.flag(PolicyOverdue, fmt.Sprintf("age %s is over the max age of %s", days(age), days(r.MaxAge)))
+	} else if age >= r.MaxAge-r.DueWithin {
+		evaluation.flag(PolicyDue, fmt.Sprintf("age %s is within %s of the max age of %s",
+			days(age), days(r.DueWithin), days(r.MaxAge)))
+	}
+}
+
+//evaluateLifeRemaining flags expired keys, and expiring keys nearing or below
+//MinLifeRemaining
+func (r PolicyRule) evaluateLifeRemaining(evaluation *KeyEvaluation) {
+	if evaluation.Key.LifeRemaining < 0 {
+		evaluation.flag(PolicyOverdue, fmt.Sprintf("expired %s ago", days(-minutes(evaluation.Key.LifeRemaining))))
+		return
+	}
+	if r.MinLifeRemaining <= 0 || evaluation.Key.LifeRemaining == 0 {
+		return
+	}
+	lifeRemaining := minutes(evaluation.Key.LifeRemaining)
+	if lifeRemaining < r.MinLifeRemaining {
+		evaluation.flag(PolicyOverdue, fmt.Sprintf("life remaining %s is under the minimum of %s",
+			days(lifeRemaining), days(r.MinLifeRemaining)))
+	} else if lifeRemaining < r.MinLifeRemaining+r.DueWithin {
+		evaluation.flag(PolicyDue, fmt.Sprintf("life remaining %s is within %s of the minimum of %s",
+			days(lifeRemaining), days(r.DueWithin), days(r.MinLifeRemaining)))
+	}
+}
+
+//evaluateKeyCount flags keys[index] if it's one of the oldest keys over its
+//account's MaxKeysPerAccount. accountKeys are the indices of the account's
+//keys in keys
+func (r PolicyRule) evaluateKeyCount(evaluation *KeyEvaluation, index int, keys []Key, accountKeys []int) {
+	if r.MaxKeysPerAccount <= 0 || len(accountKeys) <= r.MaxKeysPerAccount {
+		return
+	}
+	newestFirst := append([]int{}, accountKeys...)
+	sort.SliceStable(newestFirst, func(i, j int) bool {
+		return keys[newestFirst[i]].Age < keys[newestFirst[j]].Age
+	})
+	for _, i := range newestFirst[r.MaxKeysPerAccount:] {
+		if i == index {
+			evaluation.flag(PolicyDue, fmt.Sprintf("the account has %d keys, over the max of %d",
+				len(accountKeys), r.MaxKeysPerAccount))
+			return
+		}
+	}
+}
+
+//flag records reason, and raises the evaluation's status to status if it's
+//worse
+func (e *KeyEvaluation) flag(status PolicyStatus, reason string) {
+	if status == PolicyOverdue || e.Status == PolicyCompliant {
+		e.Status = status
+	}
+	e.Reasons = append(e.Reasons, reason)
+}
+
+//policyAccount identifies the account a key belongs to, across providers,
+//scopes and AWS accounts
+func policyAccount(key Key) string {
+	return fmt.Sprintf("%s/%s/%s/%s", key.Provider.Provider, key.Provider.Scope(),
+		key.Provider.AwsRole.AccountID, key.Account)
+}
+
+//minutes converts a number of minutes, as Key.Age and Key.LifeRemaining are
+//measured in, to a Duration
+func minutes(m float64) time.Duration {
+	return time.Duration(m * float64(time.Minute))
+}
+
+//days formats d as a number of days, to 1 decimal place
+func days(d time.Duration) string {
+	return strconv.FormatFloat(math.Round(d.Hours()/24*10)/10, 'f', -1, 64) + "d"
+}
@@ -0,0 +1,86 @@
+package keys
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+const day = 24 * time.Hour
+
+// policyTestKey returns a key aged ageDays, with lifeDays of life remaining
+func policyTestKey(provider, account, id string, ageDays, lifeDays float64) Key {
+	return Key{
+		Account:       account,
+		FullAccount:   account + "@example.com",
+		Age:           ageDays * 24 * 60,
+		ID:            id,
+		LifeRemaining: lifeDays * 24 * 60,
+		Provider:      Provider{Provider: provider},
+	}
+}
+
+var testPolicy = Policy{Rules: []PolicyRule{
+	{Account: "break-glass", Exempt: true},
+	{Provider: aivenProviderString, MinLifeRemaining: 7 * day, DueWithin: 7 * day},
+	{Account: "ci-*", MaxAge: 30 * day, DueWithin: 5 * day, MaxKeysPerAccount: 1},
+	{Provider: gcpProviderString, MaxAge: 90 * day, DueWithin: 14 * day},
+}}
+
+var policyTests = []struct {
+	key     Key
+	status  PolicyStatus
+	reasons []string
+}{
+	{policyTestKey(gcpProviderString, "break-glass", "a", 400, 0), PolicyExempt, []string{"the account is exempt (rule 0)"}},
+	{policyTestKey(awsProviderString, "app", "b", 400, 0), PolicyExempt, []string{"no policy rule matches the key"}},
+	{policyTestKey(gcpProviderString, "app", "c", 10, 0), PolicyCompliant, nil},
+	{policyTestKey(gcpProviderString, "app", "d", 80, 0), PolicyDue, []string{"age 80d is within 14d of the max age of 90d"}},
+	{policyTestKey(gcpProviderString, "app", "e", 90.5, 0), PolicyOverdue, []string{"age 90.5d is over the max age of 90d"}},
+	{policyTestKey(gcpProviderString, "app", "j", 10, -5), PolicyOverdue, []string{"expired 5d ago"}},
+	{policyTestKey(aivenProviderString, "token", "f", 400, 0), PolicyCompliant, nil},
+	{policyTestKey(aivenProviderString, "token", "g", 1, 10), PolicyDue, []string{"life remaining 10d is within 7d of the minimum of 7d"}},
+	{policyTestKey(aivenProviderString, "token", "h", 1, 2), PolicyOverdue, []string{"life remaining 2d is under the minimum of 7d"}},
+	{policyTestKey(aivenProviderString, "token", "i", 10, -3), PolicyOverdue, []string{"expired 3d ago"}},
+}
+
+func TestPolicyEvaluate(t *testing.T) {
+	for _, test := range policyTests {
+		evaluation := testPolicy.Evaluate([]Key{test.key})[0]
+		if evaluation.Status != test.status || !reflect.DeepEqual(evaluation.Reasons, test.reasons) {
+			t.Errorf("%s: got %s %q, want %s %q",
+				test.key.ID, evaluation.Status, evaluation.Reasons, test.status, test.reasons)
+		}
+	}
+}
+
+func TestPolicyMaxKeysPerAccount(t *testing.T) {
+	evaluations := testPolicy.Evaluate([]Key{
+		policyTestKey(awsProviderString, "ci-deploy", "old", 27, 0),
+		policyTestKey(awsProviderString, "ci-deploy", "new", 1, 0),
+		policyTestKey(awsProviderString, "ci-test", "other", 2, 0),
+	})
+	var statuses []PolicyStatus
+	for _, evaluation := range evaluations {
+		statuses = append(statuses, evaluation.Status)
+	}
+	if expected := []PolicyStatus{PolicyDue, PolicyCompliant, PolicyCompliant}; !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("got statuses %v, want %v", statuses, expected)
+	}
+	expectedReasons := []string{
+		"age 27d is within 5d of the max age of 30d",
+		"the account has 2 keys, over the max of 1",
+	}
+	if !reflect.DeepEqual(evaluations[0].Reasons, expectedReasons) {
+		t.Errorf("got reasons %q, want %q", evaluations[0].Reasons, expectedReasons)
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	if err := testPolicy.Validate(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if err := (Policy{Rules: []PolicyRule{{Account: "ci-["}}}).Validate(); err == nil {
+		t.Error("got no error for a malformed account pattern")
+	}
+}
@@ -0,0 +1,112 @@
+package keys
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+//defaultRollbackTimeout bounds deleting a new key after a failed rotation, if
+//RotateOptions.RollbackTimeout isn't set
+const defaultRollbackTimeout = time.Minute
+
+//RotateStage is a stage of a key rotation
+type RotateStage string
+
+//The stages of a key rotation, in the order they're run
+const (
+	RotateStageCreate  RotateStage = "create"
+	RotateStageDeliver RotateStage = "deliver"
+	RotateStageVerify  RotateStage = "verify"
+	RotateStageRetire  RotateStage = "retire"
+)
+
+//RotateOptions configures how Rotate replaces a key
+type RotateOptions struct {
+	//Deliver hands the new key to whatever uses it, e.g. by writing it to a
+	//secret store. It's required
+	Deliver func(ctx context.Context, credential Credential) error
+	//Verify checks the new key works once it's been delivered. Verification
+	//is skipped if it's nil
+	Verify func(ctx context.Context, credential Credential) error
+	//DisableOldKey disables the old key rather than deleting it, so it can
+	//be enabled again if needed. The provider must implement KeyStatusUpdater
+	DisableOldKey bool
+	//RollbackTimeout bounds how long deleting the new key after a failed
+	//delivery or verification may take. Zero or less uses the default of one
+	//minute
+	RollbackTimeout time.Duration
+}
+
+//Rotate replaces key with a new key in the same account: the new key is
+//created, delivered and (optionally) verified, then the old key is disabled
+//or deleted. If delivery or verification fails, the new key is deleted and
+//the old key is left as it was
+func Rotate(key Key, opts RotateOptions) (Credential, error) {
+	return RotateWithContext(context.Background(), key, opts)
+}
+
+//RotateWithContext replaces key with a new key in the same account, giving up
+//once ctx is done. Rolling back a new key is attempted even if ctx is done, so
+//it isn't left behind, for up to opts.RollbackTimeout
+func RotateWithContext(ctx context.Context, key Key, opts RotateOptions) (credential Credential, err error) {
+	if opts.Deliver == nil {
+		err = errors.New("RotateOptions.Deliver needs to be set, so the new key isn't lost")
+		return
+	}
+	if opts.DisableOldKey {
+		// fail before creating a key that couldn't be rotated in
+		if _, err = keyStatusUpdater(key.Provider.Provider); err != nil {
+			return
+		}
+	}
+	keyID, newKey, err := CreateKeyWithContext(ctx, key)
+	if err != nil {
+		err = &RotateError{Stage: RotateStageCreate, Err: err}
+		return
+	}
+	newKeyWithID := key
+	newKeyWithID.ID = keyID
+	if credential, err = NewCredential(key.Provider.Provider, keyID, newKey); err != nil {
+		err = rollback(RotateStageCreate, newKeyWithID, err, opts.RollbackTimeout)
+		return
+	}
+	if err = opts.Deliver(ctx, credential); err != nil {
+		err = rollback(RotateStageDeliver, newKeyWithID, err, opts.RollbackTimeout)
+		return
+	}
+	if opts.Verify != nil {
+		if err = opts.Verify(ctx, credential); err != nil {
+			err = rollback(RotateStageVerify, newKeyWithID, err, opts.RollbackTimeout)
+			return
+		}
+	}
+	if opts.DisableOldKey {
+		err = DisableKeyWithContext(ctx, key)
+	} else {
+		err = DeleteKeyWithContext(ctx, key)
+	}
+	if err != nil {
+		// the new key has been delivered, so it's kept
+		err = &RotateError{Stage: RotateStageRetire, KeyID: keyID, Err: err}
+	}
+	return
+}
+
+//rollback deletes the new key after stage failed with err, returning the
+//RotateError describing both. The deletion isn't tied to the rotation's
+//context, which may be why it failed, but is still bounded by timeout
+func rollback(stage RotateStage, newKey Key, err error, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = defaultRollbackTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return &RotateError{
+		Stage:       stage,
+		KeyID:       newKey.ID,
+		Err:         err,
+		RollbackErr: DeleteKeyWithContext(ctx, newKey),
+		RolledBack:  true,
+	}
+}
@@ -0,0 +1,148 @@
+package keys
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// rotateTestProvider records the key operations made through it
+type rotateTestProvider struct {
+	calls     *[]string
+	deleteErr error
+	// hangDelete makes deleting the new key block until its context is done
+	hangDelete bool
+}
+
+func (r rotateTestProvider) KeysWithContext(ctx context.Context, provider Provider, includeInactiveKeys bool) ([]Key, error) {
+	return nil, nil
+}
+
+func (r rotateTestProvider) CreateKeyWithContext(ctx context.Context, provider Provider, account string) (string, string, error) {
+	*r.calls = append(*r.calls, "create "+account)
+	return "new", "secret", nil
+}
+
+func (r rotateTestProvider) DeleteKeyWithContext(ctx context.Context, key Key) error {
+	*r.calls = append(*r.calls, "delete "+key.ID)
+	if key.ID == "old" {
+		return r.deleteErr
+	}
+	if r.hangDelete {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (r rotateTestProvider) DisableKeyWithContext(ctx context.Context, key Key) error {
+	*r.calls = append(*r.calls, "disable "+key.ID)
+	return nil
+}
+
+func (r rotateTestProvider) EnableKeyWithContext(ctx context.Context, key Key) error {
+	return nil
+}
+
+var errRotateTest = errors.New("failed")
+
+var rotateTests = []struct {
+	name      string
+	deliver   error
+	verify    error
+	deleteErr error
+	disable   bool
+	calls     []string
+	stage     RotateStage
+}{
+	{"delete", nil, nil, nil, false, []string{"create account", "deliver new", "verify new", "delete old"}, ""},
+	{"disable", nil, nil, nil, true, []string{"create account", "deliver new", "verify new", "disable old"}, ""},
+	{"delivery fails", errRotateTest, nil, nil, false, []string{"create account", "deliver new", "delete new"}, RotateStageDeliver},
+	{"verification fails", nil, errRotateTest, nil, false, []string{"create account", "deliver new", "verify new", "delete new"}, RotateStageVerify},
+	{"delete fails", nil, nil, errRotateTest, false, []string{"create account", "deliver new", "verify new", "delete old"}, RotateStageRetire},
+}
+
+func TestRotate(t *testing.T) {
+	for _, test := range rotateTests {
+		var calls []string
+		RegisterProviderWithContext("rotating", rotateTestProvider{calls: &calls, deleteErr: test.deleteErr})
+		key := Key{FullAccount: "account", ID: "old", Provider: Provider{Provider: "rotating"}}
+		credential, err := Rotate(key, RotateOptions{
+			Deliver: func(ctx context.Context, credential Credential) error {
+				calls = append(calls, "deliver "+credential.KeyID)
+				return test.deliver
+			},
+			Verify: func(ctx context.Context, credential Credential) error {
+				calls = append(calls, "verify "+credential.KeyID)
+				return test.verify
+			},
+			DisableOldKey: test.disable,
+		})
+		delete(providerMap, "rotating")
+
+		if !reflect.DeepEqual(calls, test.calls) {
+			t.Errorf("%s: got calls %v, want %v", test.name, calls, test.calls)
+		}
+		var rotateErr *RotateError
+		if test.stage == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", test.name, err)
+			} else if credential.KeyID != "new" || credential.Secret != "secret" {
+				t.Errorf("%s: Incorrect credential returned, got: %+v", test.name, credential)
+			}
+		} else if !errors.As(err, &rotateErr) || rotateErr.Stage != test.stage || !errors.Is(err, errRotateTest) {
+			t.Errorf("%s: got error %v, want a RotateError at the %s stage", test.name, err, test.stage)
+		}
+	}
+}
+
+func TestRotateLegacyProvider(t *testing.T) {
+	RegisterProvider("legacy", legacyTestProvider{})
+	defer delete(providerMap, "legacy")
+	var delivered Credential
+	credential, err := Rotate(Key{FullAccount: "account", ID: "old", Provider: Provider{Provider: "legacy"}}, RotateOptions{
+		Deliver: func(ctx context.Context, credential Credential) error {
+			delivered = credential
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if credential != delivered || credential.KeyID != "id" {
+		t.Errorf("got credential %+v, delivered %+v", credential, delivered)
+	}
+
+	_, err = Rotate(Key{Provider: Provider{Provider: "legacy"}}, RotateOptions{
+		Deliver:       func(ctx context.Context, credential Credential) error { return nil },
+		DisableOldKey: true,
+	})
+	if !errors.Is(err, ErrNotSupported) {
+		t.Errorf("got error %v, want ErrNotSupported", err)
+	}
+}
+
+func TestRotateRollbackTimeout(t *testing.T) {
+	var calls []string
+	RegisterProviderWithContext("rotating", rotateTestProvider{calls: &calls, hangDelete: true})
+	defer delete(providerMap, "rotating")
+	_, err := Rotate(Key{FullAccount: "account", ID: "old", Provider: Provider{Provider: "rotating"}}, RotateOptions{
+		Deliver:         func(ctx context.Context, credential Credential) error { return errRotateTest },
+		RollbackTimeout: 10 * time.Millisecond,
+	})
+	var rotateErr *RotateError
+	if !errors.As(err, &rotateErr) || !errors.Is(rotateErr.RollbackErr, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want a RotateError whose rollback timed out", err)
+	}
+}
+
+func TestRotateRequiresDeliver(t *testing.T) {
+	var calls []string
+	RegisterProviderWithContext("rotating", rotateTestProvider{calls: &calls})
+	defer delete(providerMap, "rotating")
+	if _, err := Rotate(Key{Provider: Provider{Provider: "rotating"}}, RotateOptions{}); err == nil || len(calls) > 0 {
+		t.Errorf("got error %v after calls %v, want an error before any calls", err, calls)
+	}
+}